@@ -0,0 +1,181 @@
+package hacktheconn
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// ConnRecycleReason tells why a connection was recycled.
+type ConnRecycleReason string
+
+const (
+	ConnRecycleReasonMaxAge      ConnRecycleReason = "max_age"
+	ConnRecycleReasonMaxRequests ConnRecycleReason = "max_requests"
+)
+
+// ConnRecycleEvent reports a connection being recycled. The connection serves
+// the request that hit the limit and is closed once its response is done.
+type ConnRecycleEvent struct {
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	Reason     ConnRecycleReason
+	// Age is the time since the connection was dialed.
+	Age time.Duration
+	// Requests is the number of requests served, including the last one.
+	Requests int
+}
+
+// ConnLimits bounds the lifetime of connections, so that they are recycled
+// and new ones reach backends added behind an upstream load balancer. Zero
+// fields disable the corresponding limit.
+//
+// Limits are enforced on requests made through StrategyTransport: the
+// connection of the request that hits a limit is closed once its response is
+// done, so no request in flight is cut. A connection handed out again before
+// that is closed before the request is written, and the transport retries the
+// request on a new connection if it can be replayed.
+type ConnLimits struct {
+	// MaxAge is the maximum time a connection is reused for.
+	MaxAge time.Duration
+	// MaxRequests is the maximum number of requests a connection serves.
+	MaxRequests int
+	// Jitter lowers the limits of every connection by a random fraction up to
+	// this one, e.g. 0.1 for 10%, so that connections do not all recycle at once.
+	Jitter float64
+	// OnRecycle is called whenever a connection is recycled.
+	OnRecycle func(ConnRecycleEvent)
+}
+
+func (l ConnLimits) enabled() bool {
+	return l.MaxAge > 0 || l.MaxRequests > 0
+}
+
+// jitter lowers limit by a random fraction up to l.Jitter.
+func (l ConnLimits) jitter(limit int64) int64 {
+	if l.Jitter <= 0 || limit <= 0 {
+		return limit
+	}
+	return limit - rand.N(int64(float64(limit)*min(l.Jitter, 1))+1)
+}
+
+// limitDial wraps dial so that the connections it opens carry limits.
+func limitDial(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+	limits ConnLimits,
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		return &limitedConn{
+			Conn:        conn,
+			limits:      limits,
+			dialedAt:    time.Now(),
+			maxAge:      time.Duration(limits.jitter(int64(limits.MaxAge))),
+			maxRequests: limits.jitter(int64(limits.MaxRequests)),
+		}, nil
+	}
+}
+
+// limitedConn is a connection carrying its own lifetime limits.
+type limitedConn struct {
+	net.Conn
+	limits      ConnLimits
+	dialedAt    time.Time
+	maxAge      time.Duration
+	maxRequests int64
+
+	requests atomic.Int64
+	recycled atomic.Bool
+}
+
+// reserve counts a request on the connection and reports whether it must be
+// the last one.
+func (c *limitedConn) reserve() bool {
+	requests := c.requests.Add(1)
+	age := time.Since(c.dialedAt)
+
+	var reason ConnRecycleReason
+	switch {
+	case c.maxRequests > 0 && requests >= c.maxRequests:
+		reason = ConnRecycleReasonMaxRequests
+	case c.maxAge > 0 && age >= c.maxAge:
+		reason = ConnRecycleReasonMaxAge
+	default:
+		return false
+	}
+
+	if c.recycled.CompareAndSwap(false, true) && c.limits.OnRecycle != nil {
+		c.limits.OnRecycle(ConnRecycleEvent{
+			LocalAddr:  c.LocalAddr(),
+			RemoteAddr: c.RemoteAddr(),
+			Reason:     reason,
+			Age:        age,
+			Requests:   int(requests),
+		})
+	}
+	return true
+}
+
+// findLimitedConn returns the limitedConn under conn, looking through TLS.
+func findLimitedConn(conn net.Conn) *limitedConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *limitedConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// withConnRecycling returns a copy of req that enforces the limits of the
+// connection it is sent on, and a function closing that connection if the
+// request was its last one. It must be called once the response is done.
+func withConnRecycling(req *http.Request) (*http.Request, func()) {
+	var (
+		traced *http.Request
+		last   *limitedConn
+	)
+
+	// GotConn runs before the request is written, in the goroutine calling
+	// RoundTrip, so setting Close there is safe. The transport only honors it
+	// for requests without a body, as it sends a copy of the others: their
+	// connection is closed by the returned function instead.
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := findLimitedConn(info.Conn)
+			switch {
+			case conn == nil:
+			case conn.recycled.Load():
+				// The connection went idle before being closed. Nothing
+				// is written on it yet, so the transport retries elsewhere.
+				_ = conn.Close()
+			case conn.reserve():
+				traced.Close = true
+				last = conn
+			}
+		},
+	}
+
+	traced = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return traced, func() {
+		if last != nil {
+			_ = last.Close()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package hacktheconn
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newConnCountingServer starts a server counting the connections it accepts.
+func newConnCountingServer(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var conns atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return server, &conns
+}
+
+func get(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+
+	res, err := client.Get(url)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+}
+
+type recycleRecorder struct {
+	mutex  sync.Mutex
+	events []ConnRecycleEvent
+}
+
+func (r *recycleRecorder) record(event ConnRecycleEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+func TestConnLimitsMaxRequests(t *testing.T) {
+	server, conns := newConnCountingServer(t)
+	recorder := &recycleRecorder{}
+
+	transport, err := DirectTransport(
+		OptTransportWithMaxConnRequests(3),
+		OptTransportWithConnRecycleHandler(recorder.record),
+	)
+	require.NoError(t, err)
+	client := &http.Client{Transport: Transport(NewRoundRobinStrategy([]http.RoundTripper{transport}))}
+
+	for range 7 {
+		get(t, client, server.URL)
+	}
+
+	assert.Equal(t, int64(3), conns.Load())
+	require.Len(t, recorder.events, 2)
+	assert.Equal(t, ConnRecycleReasonMaxRequests, recorder.events[0].Reason)
+	assert.Equal(t, 3, recorder.events[0].Requests)
+}
+
+func TestConnLimitsMaxRequestsWithBody(t *testing.T) {
+	server, conns := newConnCountingServer(t)
+	recorder := &recycleRecorder{}
+
+	transport, err := DirectTransport(
+		OptTransportWithMaxConnRequests(2),
+		OptTransportWithConnRecycleHandler(recorder.record),
+	)
+	require.NoError(t, err)
+	client := &http.Client{Transport: Transport(NewRoundRobinStrategy([]http.RoundTripper{transport}))}
+
+	for range 5 {
+		res, err := client.Post(server.URL, "text/plain", strings.NewReader("hello"))
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+	}
+
+	assert.Equal(t, int64(3), conns.Load())
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	assert.Len(t, recorder.events, 2)
+}
+
+func TestConnLimitsMaxAge(t *testing.T) {
+	server, conns := newConnCountingServer(t)
+	recorder := &recycleRecorder{}
+
+	transport, err := NewTransportFactory(
+		OptTransportWithMaxConnAge(20*time.Millisecond),
+		OptTransportWithConnRecycleHandler(recorder.record),
+	)("direct://")
+	require.NoError(t, err)
+	client := &http.Client{Transport: Transport(NewRoundRobinStrategy([]http.RoundTripper{transport}))}
+
+	get(t, client, server.URL)
+	get(t, client, server.URL)
+	assert.Equal(t, int64(1), conns.Load())
+
+	time.Sleep(30 * time.Millisecond)
+	get(t, client, server.URL)
+	get(t, client, server.URL)
+
+	assert.Equal(t, int64(2), conns.Load())
+	require.Len(t, recorder.events, 1)
+	assert.Equal(t, ConnRecycleReasonMaxAge, recorder.events[0].Reason)
+	assert.GreaterOrEqual(t, recorder.events[0].Age, 20*time.Millisecond)
+}
+
+func TestConnLimitsJitter(t *testing.T) {
+	limits := ConnLimits{Jitter: 0.1}
+	for range 100 {
+		limit := limits.jitter(1000)
+		assert.GreaterOrEqual(t, limit, int64(900))
+		assert.LessOrEqual(t, limit, int64(1000))
+	}
+
+	assert.Equal(t, int64(1000), ConnLimits{}.jitter(1000))
+}
@@ -12,7 +12,10 @@ handling for distributed systems.
 # Features
 
 - **Round-Robin Strategy**: Distributes requests evenly across all available transports.
+- **Weighted Round-Robin Strategy**: Distributes requests proportionally to per-transport weights.
 - **Fill Holes Strategy**: Selects the transport with the fewest concurrent requests.
+- **Power of Two Choices Strategy**: Picks the less loaded of two random transports by in-flight count and latency.
+- **Consistent Hash Strategy**: Routes requests with the same key through the same transport.
 - **Least Response Time Strategy**: Dynamically picks the transport with the lowest response time using:
   - Last Response Time
   - Moving Average
@@ -70,7 +73,8 @@ Example:
 ## Least Response Time Strategy
 
 Selects the transport with the lowest response time. Response time calculation can be configured using
-predefined calculators or custom ones.
+predefined calculators or custom ones. Calculators are passed as a ResponseTimeCalculatorFactory, so that
+every transport averages its own response times.
 
 ### Predefined Calculators:
 - `LeastResponseTimeLastResponseTimeCalculator`: Uses the most recent response time.
@@ -102,9 +106,9 @@ Example with Weighted Average:
 
 ## Custom Strategies
 
-To define a custom strategy, implement the `strategy` interface:
+To define a custom strategy, implement the `Strategy` interface:
 
-	type strategy interface {
+	type Strategy interface {
 		Acquire() (http.RoundTripper, error)
 		Release(http.RoundTripper)
 	}
@@ -121,6 +125,15 @@ Example:
 		// Custom cleanup logic
 	}
 
+Strategies may also implement `RequestAcquirer` to select a transport based on the request, and
+`ResultReleaser` to learn the outcome of each request (status code, error, duration, bytes):
+
+	func (cs *CustomStrategy) ReleaseResult(rt http.RoundTripper, result Result) {
+		if result.Failed() {
+			// Penalize rt
+		}
+	}
+
 # Contributing
 
 Contributions are welcome! Please ensure your code is documented and tested.
@@ -4,4 +4,13 @@ import "errors"
 
 var (
 	ErrNoTransports = errors.New("no transports available")
+	ErrCircuitOpen  = errors.New("circuit breaker open for every transport")
+	ErrUnknownProxy = errors.New("proxy not in pool")
+	ErrNoProxies    = errors.New("proxy provider returned no proxies")
+	ErrShutdown     = errors.New("transport is shut down")
+	ErrPinMismatch  = errors.New("no certificate matches the pinned public keys")
+	ErrBadInterval  = errors.New("interval must be greater than 0")
+
+	ErrProxyAuthRequired = errors.New("proxy authentication required")
+	ErrUnsupportedScheme = errors.New("unsupported proxy URL scheme")
 )
@@ -0,0 +1,256 @@
+package hacktheconn
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// HedgePolicy configures request hedging: when a request has not been
+// answered within the hedge delay, another copy is sent on a different
+// transport, and the first response wins. Zero fields take their documented
+// defaults.
+type HedgePolicy struct {
+	// Delay is the time to wait for a response before sending a hedge. With
+	// Percentile set, it is only used until the transport has latency samples.
+	// Defaults to 100ms.
+	Delay time.Duration
+	// Percentile, between 0 and 1, makes the delay adaptive: it becomes that
+	// percentile of the recent latencies of the transport the previous copy was
+	// sent on, e.g. 0.95 for p95. Zero keeps the delay fixed.
+	Percentile float64
+	// Window is the number of latency samples kept per transport for the
+	// adaptive delay. Defaults to 100.
+	Window int
+	// MaxHedges is the maximum number of hedges sent per request. Defaults to 1.
+	MaxHedges int
+	// Budget caps the number of hedges across all requests. Nil means no cap.
+	Budget *RetryBudget
+}
+
+func (p HedgePolicy) withDefaults() HedgePolicy {
+	if p.Delay <= 0 {
+		p.Delay = 100 * time.Millisecond
+	}
+	if p.Window <= 0 {
+		p.Window = 100
+	}
+	if p.MaxHedges <= 0 {
+		p.MaxHedges = 1
+	}
+	return p
+}
+
+// latencyWindow keeps the latest latency samples of a transport.
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func (w *latencyWindow) add(latency time.Duration) {
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	if n == 0 {
+		return 0, false
+	}
+
+	sorted := slices.Clone(w.samples[:n])
+	slices.Sort(sorted)
+
+	return sorted[min(int(p*float64(n)), n-1)], true
+}
+
+// hedger tracks the latencies used for adaptive hedge delays.
+type hedger struct {
+	policy HedgePolicy
+
+	mutex     sync.Mutex
+	latencies map[http.RoundTripper]*latencyWindow
+}
+
+func newHedger(policy HedgePolicy) *hedger {
+	return &hedger{
+		policy:    policy.withDefaults(),
+		latencies: make(map[http.RoundTripper]*latencyWindow),
+	}
+}
+
+func (h *hedger) observe(transport http.RoundTripper, latency time.Duration) {
+	if h.policy.Percentile <= 0 {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	window, ok := h.latencies[transport]
+	if !ok {
+		window = &latencyWindow{samples: make([]time.Duration, h.policy.Window)}
+		h.latencies[transport] = window
+	}
+	window.add(latency)
+}
+
+func (h *hedger) delay(transport http.RoundTripper) time.Duration {
+	if h.policy.Percentile <= 0 {
+		return h.policy.Delay
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if window, ok := h.latencies[transport]; ok {
+		if delay, ok := window.percentile(h.policy.Percentile); ok {
+			return delay
+		}
+	}
+	return h.policy.Delay
+}
+
+// hedgeAttempt is the outcome of one copy of a hedged request.
+type hedgeAttempt struct {
+	id  int
+	res *http.Response
+	err error
+}
+
+// roundTripWithHedging sends the request and hedges it on other transports
+// while it goes unanswered. The first response wins and the other copies are
+// canceled through their context.
+func (t *StrategyTransport) roundTripWithHedging(req *http.Request, h *hedger) (*http.Response, error) {
+	if !isIdempotent(req) || !isReplayable(req) {
+		transport, err := t.strategy.AcquireRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		return t.roundTrip(req, transport)
+	}
+
+	if h.policy.Budget != nil {
+		h.policy.Budget.deposit()
+	}
+
+	results := make(chan hedgeAttempt)
+	tried := make(map[http.RoundTripper]bool)
+	var (
+		cancels  []context.CancelFunc
+		inFlight int
+		hedges   int
+		last     http.RoundTripper
+		errs     []error
+	)
+
+	send := func(attemptReq *http.Request) error {
+		transport, err := t.acquireSkipping(attemptReq, func(rt http.RoundTripper) bool { return tried[rt] })
+		if err != nil {
+			return err
+		}
+		tried[transport] = true
+		last = transport
+		inFlight++
+
+		ctx, cancel := context.WithCancel(req.Context())
+		id := len(cancels)
+		cancels = append(cancels, cancel)
+
+		go func() {
+			start := time.Now()
+			res, err := t.roundTrip(attemptReq.WithContext(ctx), transport)
+			if err == nil {
+				h.observe(transport, time.Since(start))
+			}
+			results <- hedgeAttempt{id: id, res: res, err: err}
+		}()
+		return nil
+	}
+
+	// hedge sends another copy if the policy and budget allow it, unless the
+	// caller gave up on the request.
+	hedge := func() bool {
+		if req.Context().Err() != nil {
+			return false
+		}
+		if hedges >= h.policy.MaxHedges || (h.policy.Budget != nil && !h.policy.Budget.withdraw()) {
+			return false
+		}
+		attemptReq, err := rewindBody(req)
+		if err == nil {
+			err = send(attemptReq)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			return false
+		}
+		hedges++
+		return true
+	}
+
+	if err := send(req); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(h.delay(last))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if hedge() {
+				timer.Reset(h.delay(last))
+			}
+		case attempt := <-results:
+			inFlight--
+			if attempt.err == nil {
+				for id, cancel := range cancels {
+					if id != attempt.id {
+						cancel()
+					}
+				}
+				wrapResponseBody(attempt.res, func(int64, error) { cancels[attempt.id]() })
+				go discardHedges(results, inFlight)
+				return attempt.res, nil
+			}
+
+			cancels[attempt.id]()
+			errs = append(errs, attempt.err)
+			if inFlight == 0 && !hedge() {
+				return nil, errors.Join(errs...)
+			}
+		}
+	}
+}
+
+// discardHedges closes the responses of the copies of a hedged request that
+// lost the race, as they come in after being canceled.
+func discardHedges(results <-chan hedgeAttempt, inFlight int) {
+	for range inFlight {
+		if attempt := <-results; attempt.res != nil {
+			_ = attempt.res.Body.Close()
+		}
+	}
+}
+
+// OptStrategyTransportWithHedging enables request hedging with any strategy.
+// Only idempotent requests, by method or Idempotency-Key header, whose body
+// can be replayed through GetBody are hedged. A copy failing with no other in
+// flight is hedged right away, so hedging takes the place of retries when both
+// are configured.
+func OptStrategyTransportWithHedging(policy HedgePolicy) OptStrategyTransport {
+	return func(cfg *StrategyTransportConfig) {
+		cfg.hedge = &policy
+	}
+}
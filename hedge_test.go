@@ -0,0 +1,152 @@
+package hacktheconn
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// delayedTransport answers after a delay, unless the request is canceled first.
+type delayedTransport struct {
+	ID       string
+	delay    time.Duration
+	calls    atomic.Int64
+	canceled atomic.Int64
+}
+
+func (d *delayedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	d.calls.Add(1)
+
+	select {
+	case <-time.After(d.delay):
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(d.ID))}, nil
+	case <-req.Context().Done():
+		d.canceled.Add(1)
+		return nil, req.Context().Err()
+	}
+}
+
+func readBody(t *testing.T, res *http.Response) string {
+	t.Helper()
+
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	return string(data)
+}
+
+func TestHedgingFirstResponseWins(t *testing.T) {
+	slow := &delayedTransport{ID: "slow", delay: time.Second}
+	fast := &delayedTransport{ID: "fast", delay: 5 * time.Millisecond}
+
+	tr := Transport(
+		NewRoundRobinStrategy([]http.RoundTripper{slow, fast}),
+		OptStrategyTransportWithHedging(HedgePolicy{Delay: 20 * time.Millisecond}),
+	)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	res, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "fast", readBody(t, res))
+
+	assert.Eventually(t, func() bool { return slow.canceled.Load() == 1 }, time.Second, time.Millisecond)
+}
+
+func TestHedgingNotNeeded(t *testing.T) {
+	a := &delayedTransport{ID: "A", delay: time.Millisecond}
+	b := &delayedTransport{ID: "B", delay: time.Millisecond}
+
+	tr := Transport(
+		NewRoundRobinStrategy([]http.RoundTripper{a, b}),
+		OptStrategyTransportWithHedging(HedgePolicy{Delay: time.Second}),
+	)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	res, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "A", readBody(t, res))
+	assert.Equal(t, int64(0), b.calls.Load())
+}
+
+func TestHedgingBudgetAndNonIdempotent(t *testing.T) {
+	newTransport := func(policy HedgePolicy) (*StrategyTransport, *delayedTransport) {
+		slow := &delayedTransport{ID: "slow", delay: 50 * time.Millisecond}
+		other := &delayedTransport{ID: "other", delay: 50 * time.Millisecond}
+		return Transport(NewRoundRobinStrategy([]http.RoundTripper{slow, other}), OptStrategyTransportWithHedging(policy)), other
+	}
+
+	policy := HedgePolicy{Delay: time.Millisecond, Budget: NewRetryBudget(0, 1)}
+	tr, other := newTransport(policy)
+	for range 3 {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		res, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+		readBody(t, res)
+	}
+	// The budget holds a single hedge. Round-robin also sends the third
+	// request to the other transport.
+	assert.Equal(t, int64(2), other.calls.Load())
+
+	tr, other = newTransport(HedgePolicy{Delay: time.Millisecond})
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("x"))
+	res, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	readBody(t, res)
+	assert.Equal(t, int64(0), other.calls.Load())
+}
+
+func TestHedgingAdaptiveDelay(t *testing.T) {
+	h := newHedger(HedgePolicy{Delay: time.Second, Percentile: 0.9, Window: 10})
+	transport := &MockTransport{ID: "A"}
+
+	assert.Equal(t, time.Second, h.delay(transport))
+
+	for i := 1; i <= 20; i++ {
+		h.observe(transport, time.Duration(i)*time.Millisecond)
+	}
+	// The window holds 11ms to 20ms.
+	assert.Equal(t, 20*time.Millisecond, h.delay(transport))
+}
+
+func TestHedgingHonorsCallerCancellation(t *testing.T) {
+	slow := &delayedTransport{ID: "slow", delay: time.Second}
+	tr := Transport(
+		NewRoundRobinStrategy([]http.RoundTripper{slow}),
+		OptStrategyTransportWithHedging(HedgePolicy{Delay: time.Second}),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+	_, err := tr.RoundTrip(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestHedgingStopsOnCallerCancellation(t *testing.T) {
+	slow := &delayedTransport{ID: "slow", delay: time.Second}
+	other := &delayedTransport{ID: "other", delay: time.Second}
+	budget := NewRetryBudget(0, 1)
+	tr := Transport(
+		NewRoundRobinStrategy([]http.RoundTripper{slow, other}),
+		OptStrategyTransportWithHedging(HedgePolicy{Delay: time.Second, Budget: budget}),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+	_, err := tr.RoundTrip(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The failed copy is not hedged once the caller gave up.
+	assert.Equal(t, int64(0), other.calls.Load())
+	assert.True(t, budget.withdraw(), "the budget is not spent")
+}
@@ -0,0 +1,69 @@
+package hacktheconn
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// discardHandler drops every record. It keeps the package silent unless a
+// logger is configured.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+// loggerOrDiscard returns logger, or a logger dropping every record if nil.
+func loggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return discardLogger
+	}
+	return logger
+}
+
+// logDial wraps dial so that the connections it opens, or fails to, are logged.
+func logDial(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+	logger *slog.Logger,
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			logger.WarnContext(ctx, "dial failed",
+				"network", network, "address", address, "duration", time.Since(start), "error", err)
+			return nil, err
+		}
+
+		logger.DebugContext(ctx, "dialed",
+			"network", network, "address", address, "local_address", conn.LocalAddr().String(),
+			"duration", time.Since(start))
+		return conn, nil
+	}
+}
+
+// logTransportDials logs the connections opened by t. Transports dialing with
+// the defaults of net/http keep attempting HTTP/2.
+func logTransportDials(t *http.Transport, logger *slog.Logger) {
+	if t.DialContext == nil && t.Dial != nil {
+		return
+	}
+	if t.DialContext == nil && t.DialTLSContext == nil && t.DialTLS == nil && t.TLSClientConfig == nil {
+		t.ForceAttemptHTTP2 = true
+	}
+
+	t.DialContext = logDial(t.DialContext, logger)
+	if t.DialTLSContext != nil {
+		t.DialTLSContext = logDial(t.DialTLSContext, logger)
+	}
+}
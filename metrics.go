@@ -0,0 +1,78 @@
+package hacktheconn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// Metrics receives the traffic of a StrategyTransport, per transport. Proxies
+// are the URLs the transports were created from, with their password
+// redacted, when the transports come from a strategy constructor or a Pool,
+// and empty otherwise. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// TransportSelected is called when the transport of proxy is selected
+	// for a request, right before sending it. Retries and hedged requests
+	// select a transport for every attempt.
+	TransportSelected(proxy string)
+	// RequestDone is called once the request sent through the transport of
+	// proxy ends, with the result reported to the strategy. Requests
+	// selected and not yet done are in flight.
+	RequestDone(proxy string, result Result)
+}
+
+// MetricsForgetter is implemented by Metrics that can drop what they keep about
+// a proxy. A Pool configured with OptPoolWithMetrics calls Forget for the
+// proxies it removes, once their requests are done, so that their series do
+// not pile up as proxies rotate. Forget is called with the pool locked, so it
+// must not call the pool.
+type MetricsForgetter interface {
+	Forget(proxy string)
+}
+
+// Error classes returned by Result.ErrorClass.
+const (
+	ErrorClassTimeout     = "timeout"
+	ErrorClassCanceled    = "canceled"
+	ErrorClassProxyAuth   = "proxy_auth"
+	ErrorClassTLS         = "tls"
+	ErrorClassConnection  = "connection"
+	ErrorClassServerError = "server_error"
+	ErrorClassOther       = "other"
+)
+
+// ErrorClass classifies the failure of the request, or returns an empty
+// string if it did not fail.
+func (r Result) ErrorClass() string {
+	var (
+		netErr  net.Error
+		certErr *tls.CertificateVerificationError
+		alert   tls.AlertError
+		record  tls.RecordHeaderError
+		opErr   *net.OpError
+	)
+
+	switch {
+	case !r.Failed():
+		return ""
+	case r.Err == nil:
+		return ErrorClassServerError
+	case errors.Is(r.Err, ErrProxyAuthRequired):
+		return ErrorClassProxyAuth
+	case errors.Is(r.Err, context.Canceled):
+		return ErrorClassCanceled
+	case errors.Is(r.Err, context.DeadlineExceeded),
+		errors.As(r.Err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	case errors.Is(r.Err, ErrPinMismatch),
+		errors.As(r.Err, &certErr),
+		errors.As(r.Err, &alert),
+		errors.As(r.Err, &record):
+		return ErrorClassTLS
+	case errors.As(r.Err, &opErr):
+		return ErrorClassConnection
+	default:
+		return ErrorClassOther
+	}
+}
@@ -0,0 +1,242 @@
+package hacktheconn
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the latency
+// histogram buckets of PrometheusMetrics, as in the Prometheus clients.
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics is a Metrics keeping counters and latency histograms per
+// transport, rendered in the Prometheus text exposition format by WriteTo and
+// ServeHTTP. It depends on no Prometheus library: mount it on a metrics
+// endpoint, or write it out for a node exporter textfile collector.
+type PrometheusMetrics struct {
+	cfg PrometheusMetricsConfig
+
+	mutex      sync.Mutex
+	transports map[string]*transportMetrics
+}
+
+type (
+	// OptPrometheusMetrics configures PrometheusMetrics.
+	OptPrometheusMetrics = Option[PrometheusMetricsConfig]
+
+	PrometheusMetricsConfig struct {
+		// Namespace prefixes the metric names. Defaults to "hacktheconn".
+		Namespace string
+		// Buckets are the upper bounds, in seconds, of the latency histogram
+		// buckets. Defaults to DefaultLatencyBuckets.
+		Buckets []float64
+	}
+)
+
+// transportMetrics are the metrics of a transport.
+type transportMetrics struct {
+	// proxy is the label of the transport.
+	proxy        string
+	selections   int64
+	requests     int64
+	errors       map[string]int64
+	bytesRead    int64
+	bytesWritten int64
+	// buckets counts the requests by latency bucket, not cumulatively, the
+	// last one being +Inf.
+	buckets     []int64
+	durationSum float64
+}
+
+// NewPrometheusMetrics creates an empty PrometheusMetrics.
+func NewPrometheusMetrics(opts ...OptPrometheusMetrics) *PrometheusMetrics {
+	cfg := PrometheusMetricsConfig{
+		Namespace: "hacktheconn",
+		Buckets:   DefaultLatencyBuckets,
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	cfg.Buckets = slices.Clone(cfg.Buckets)
+	slices.Sort(cfg.Buckets)
+
+	return &PrometheusMetrics{
+		cfg:        cfg,
+		transports: make(map[string]*transportMetrics),
+	}
+}
+
+// transport returns the metrics of proxy, creating them if needed. It must be
+// called with the mutex held.
+func (m *PrometheusMetrics) transport(proxy string) *transportMetrics {
+	tm, ok := m.transports[proxy]
+	if !ok {
+		tm = &transportMetrics{
+			proxy:   redactProxy(proxy),
+			errors:  make(map[string]int64),
+			buckets: make([]int64, len(m.cfg.Buckets)+1),
+		}
+		m.transports[proxy] = tm
+	}
+	return tm
+}
+
+// TransportSelected counts a selection of the transport of proxy.
+func (m *PrometheusMetrics) TransportSelected(proxy string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.transport(proxy).selections++
+}
+
+// RequestDone records the outcome of a request sent through the transport of proxy.
+func (m *PrometheusMetrics) RequestDone(proxy string, result Result) {
+	seconds := result.Duration.Seconds()
+	bucket, _ := slices.BinarySearch(m.cfg.Buckets, seconds)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tm := m.transport(proxy)
+	tm.requests++
+	if class := result.ErrorClass(); class != "" {
+		tm.errors[class]++
+	}
+	tm.bytesRead += result.BytesRead
+	tm.bytesWritten += result.BytesWritten
+	tm.buckets[bucket]++
+	tm.durationSum += seconds
+}
+
+// Forget drops the metrics of the transport of proxy. They start again from
+// zero if the transport is selected afterwards.
+func (m *PrometheusMetrics) Forget(proxy string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.transports, proxy)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	m.render(&buf)
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+// render writes the metrics of every transport, sorted by proxy.
+func (m *PrometheusMetrics) render(buf *bytes.Buffer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	transports := make([]*transportMetrics, 0, len(m.transports))
+	for _, tm := range m.transports {
+		transports = append(transports, tm)
+	}
+	slices.SortFunc(transports, func(a, b *transportMetrics) int {
+		return strings.Compare(a.proxy, b.proxy)
+	})
+
+	series := func(name, kind, help string, value func(*transportMetrics) int64) {
+		m.header(buf, name, kind, help)
+		for _, tm := range transports {
+			fmt.Fprintf(buf, "%s{proxy=\"%s\"} %d\n", m.name(name), escapeLabel(tm.proxy), value(tm))
+		}
+	}
+
+	series("transport_selections_total", "counter", "Times the transport was selected for a request.",
+		func(tm *transportMetrics) int64 { return tm.selections })
+	series("transport_requests_total", "counter", "Requests sent through the transport that ended.",
+		func(tm *transportMetrics) int64 { return tm.requests })
+
+	m.header(buf, "transport_errors_total", "counter", "Failed requests sent through the transport, by error class.")
+	for _, tm := range transports {
+		classes := make([]string, 0, len(tm.errors))
+		for class := range tm.errors {
+			classes = append(classes, class)
+		}
+		slices.Sort(classes)
+
+		for _, class := range classes {
+			fmt.Fprintf(buf, "%s{proxy=\"%s\",class=\"%s\"} %d\n",
+				m.name("transport_errors_total"), escapeLabel(tm.proxy), class, tm.errors[class])
+		}
+	}
+
+	series("transport_in_flight", "gauge", "Requests sent through the transport that have not ended.",
+		func(tm *transportMetrics) int64 { return tm.selections - tm.requests })
+
+	series("transport_received_bytes_total", "counter", "Response body bytes read through the transport.",
+		func(tm *transportMetrics) int64 { return tm.bytesRead })
+	series("transport_sent_bytes_total", "counter", "Request body bytes sent through the transport.",
+		func(tm *transportMetrics) int64 { return tm.bytesWritten })
+
+	name := m.name("transport_request_duration_seconds")
+	m.header(buf, "transport_request_duration_seconds", "histogram",
+		"Duration of the requests sent through the transport, until their response body was read.")
+	for _, tm := range transports {
+		proxy := escapeLabel(tm.proxy)
+
+		var cumulative int64
+		for i, bound := range m.cfg.Buckets {
+			cumulative += tm.buckets[i]
+			fmt.Fprintf(buf, "%s_bucket{proxy=\"%s\",le=\"%s\"} %d\n", name, proxy, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket{proxy=\"%s\",le=\"+Inf\"} %d\n", name, proxy, tm.requests)
+		fmt.Fprintf(buf, "%s_sum{proxy=\"%s\"} %s\n", name, proxy, formatFloat(tm.durationSum))
+		fmt.Fprintf(buf, "%s_count{proxy=\"%s\"} %d\n", name, proxy, tm.requests)
+	}
+}
+
+// name returns the full name of a metric.
+func (m *PrometheusMetrics) name(name string) string {
+	if m.cfg.Namespace == "" {
+		return name
+	}
+	return m.cfg.Namespace + "_" + name
+}
+
+// header writes the HELP and TYPE lines of a metric.
+func (m *PrometheusMetrics) header(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", m.name(name), help, m.name(name), kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value of the text exposition format.
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// OptPrometheusMetricsWithNamespace configures the prefix of the metric names.
+func OptPrometheusMetricsWithNamespace(namespace string) OptPrometheusMetrics {
+	return func(cfg *PrometheusMetricsConfig) {
+		cfg.Namespace = namespace
+	}
+}
+
+// OptPrometheusMetricsWithBuckets configures the upper bounds, in seconds, of
+// the latency histogram buckets.
+func OptPrometheusMetricsWithBuckets(buckets ...float64) OptPrometheusMetrics {
+	return func(cfg *PrometheusMetricsConfig) {
+		cfg.Buckets = buckets
+	}
+}
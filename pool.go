@@ -0,0 +1,489 @@
+package hacktheconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// PoolEntry is a transport of a Pool, along with the proxy URL it was created from.
+type PoolEntry struct {
+	// Proxy is the proxy URL without its weight query parameter. It identifies
+	// the transport, e.g. on the ring of ConsistentHashStrategy.
+	Proxy     string
+	Transport http.RoundTripper
+	// Weight is read from the weight query parameter of the proxy URL, and is
+	// used by WeightedRoundRobinStrategy.
+	Weight int
+}
+
+// Pool wraps a strategy to add, remove and replace its proxies at runtime,
+// without rebuilding the http.Client. The wrapped strategy must implement
+// TransportSetter, as all built-in strategies and wrappers do.
+//
+// Removed transports stop receiving requests right away. Once their in-flight
+// requests are done, their idle connections are closed and their metrics
+// forgotten.
+type Pool struct {
+	strategy Strategy
+	adapted  RequestStrategy
+	setter   TransportSetter
+	cfg      PoolConfig
+	logger   *slog.Logger
+
+	// update serializes changes to the proxies.
+	update  sync.Mutex
+	entries []PoolEntry
+
+	mutex sync.Mutex
+	// members maps the transports of the pool to their proxy, with its
+	// password redacted.
+	members  map[http.RoundTripper]string
+	inFlight map[http.RoundTripper]int
+	// draining maps the removed transports with requests in flight to their
+	// proxy.
+	draining map[http.RoundTripper]string
+
+	watchMutex sync.Mutex
+	watches    []context.CancelFunc
+	watchers   sync.WaitGroup
+}
+
+type (
+	// OptPool configures the pool.
+	OptPool = Option[PoolConfig]
+
+	PoolConfig struct {
+		// TransportFactory creates the transport of every proxy added to the pool.
+		TransportFactory func(string) (*http.Transport, error)
+		// Logger, if set, logs the proxies added and removed, and the
+		// failures of proxy providers.
+		Logger *slog.Logger
+		// Metrics, if they implement MetricsForgetter, forget the removed
+		// proxies once their requests are done.
+		Metrics Metrics
+	}
+)
+
+// NewPool wraps s to manage its proxies at runtime. The pool starts empty,
+// replacing the transports s was created with: add proxies with Add or Replace.
+func NewPool(s Strategy, opts ...OptPool) *Pool {
+	setter, ok := s.(TransportSetter)
+	if !ok {
+		panic("pooled strategy must implement TransportSetter")
+	}
+
+	cfg := PoolConfig{
+		TransportFactory: DefaultTransportFactory,
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	setter.SetTransports(nil)
+
+	return &Pool{
+		strategy: s,
+		adapted:  AdaptStrategy(s),
+		setter:   setter,
+		cfg:      cfg,
+		logger:   loggerOrDiscard(cfg.Logger),
+		members:  make(map[http.RoundTripper]string),
+		inFlight: make(map[http.RoundTripper]int),
+		draining: make(map[http.RoundTripper]string),
+	}
+}
+
+// Add adds a proxy to the pool. Its URL may carry a weight query parameter,
+// which is stripped before the URL reaches the transport factory. Adding a
+// proxy already in the pool only updates its weight.
+func (p *Pool) Add(proxy string) error {
+	p.update.Lock()
+	defer p.update.Unlock()
+
+	entry, err := p.entry(proxy)
+	if err != nil {
+		return err
+	}
+
+	entries := slices.Clone(p.entries)
+	if i := p.index(entry.Proxy); i >= 0 {
+		if entries[i].Weight == entry.Weight {
+			return nil
+		}
+		entries[i].Weight = entry.Weight
+	} else {
+		if entry.Transport, err = p.transport(entry.Proxy); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+
+	p.apply(entries)
+	return nil
+}
+
+// Remove removes a proxy from the pool. Its transport is closed once its
+// in-flight requests are done. It returns ErrUnknownProxy if the proxy is not
+// in the pool.
+func (p *Pool) Remove(proxy string) error {
+	p.update.Lock()
+	defer p.update.Unlock()
+
+	entry, err := p.entry(proxy)
+	if err != nil {
+		return err
+	}
+
+	i := p.index(entry.Proxy)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownProxy, entry.Proxy)
+	}
+
+	p.apply(slices.Delete(slices.Clone(p.entries), i, i+1))
+	return nil
+}
+
+// Replace sets the proxies of the pool. Proxies already in the pool keep their
+// transport and state, and the ones left out are removed as with Remove.
+// Proxies that are invalid, or whose transport cannot be created, are skipped,
+// and their *ProxyError are returned joined. When every proxy fails, the pool
+// is left unchanged.
+func (p *Pool) Replace(proxies []string) error {
+	p.update.Lock()
+	defer p.update.Unlock()
+
+	var (
+		entries []PoolEntry
+		seen    = make(map[string]bool)
+		errs    []error
+	)
+	for _, proxy := range proxies {
+		entry, err := p.entry(proxy)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if seen[entry.Proxy] {
+			continue
+		}
+		seen[entry.Proxy] = true
+
+		if i := p.index(entry.Proxy); i >= 0 {
+			entry.Transport = p.entries[i].Transport
+		} else if entry.Transport, err = p.transport(entry.Proxy); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) == 0 && len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if !slices.Equal(entries, p.entries) {
+		p.apply(entries)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Proxies returns the proxy URLs of the pool, without their weight.
+func (p *Pool) Proxies() []string {
+	p.update.Lock()
+	defer p.update.Unlock()
+
+	proxies := make([]string, len(p.entries))
+	for i, entry := range p.entries {
+		proxies[i] = entry.Proxy
+	}
+	return proxies
+}
+
+// entry parses the weight of proxy.
+func (p *Pool) entry(proxy string) (PoolEntry, error) {
+	proxyURL, weight, err := parseProxyWeight(proxy)
+	if err != nil {
+		return PoolEntry{}, &ProxyError{Proxy: redactProxy(proxy), Err: err}
+	}
+	return PoolEntry{Proxy: proxyURL, Weight: weight}, nil
+}
+
+func (p *Pool) transport(proxy string) (http.RoundTripper, error) {
+	transport, err := p.cfg.TransportFactory(proxy)
+	if err != nil {
+		return nil, &ProxyError{Proxy: redactProxy(proxy), Err: err}
+	}
+	return transport, nil
+}
+
+// index returns the position of proxy in the pool, or -1. It must be called
+// with the update mutex held.
+func (p *Pool) index(proxy string) int {
+	return slices.IndexFunc(p.entries, func(entry PoolEntry) bool {
+		return entry.Proxy == proxy
+	})
+}
+
+// apply hands entries to the wrapped strategy and closes the removed
+// transports that have no request in flight. It must be called with the update
+// mutex held.
+func (p *Pool) apply(entries []PoolEntry) {
+	p.setter.SetTransports(entries)
+	p.entries = entries
+
+	members := make(map[http.RoundTripper]string, len(entries))
+	for _, entry := range entries {
+		members[entry.Transport] = redactProxy(entry.Proxy)
+	}
+
+	p.mutex.Lock()
+	var (
+		idle           []http.RoundTripper
+		added, removed []string
+		forgotten      []string
+	)
+	for transport, proxy := range p.members {
+		if _, ok := members[transport]; !ok {
+			removed = append(removed, proxy)
+			if p.inFlight[transport] == 0 {
+				idle = append(idle, transport)
+				forgotten = append(forgotten, proxy)
+			} else {
+				p.draining[transport] = proxy
+			}
+		}
+	}
+	for transport, proxy := range members {
+		if _, ok := p.members[transport]; !ok {
+			added = append(added, proxy)
+		}
+		delete(p.draining, transport)
+	}
+	p.members = members
+	for _, proxy := range forgotten {
+		p.forget(proxy)
+	}
+	p.mutex.Unlock()
+
+	if len(added) > 0 || len(removed) > 0 {
+		slices.Sort(added)
+		slices.Sort(removed)
+		p.logger.Info("pool proxies changed", "added", added, "removed", removed, "proxies", len(entries))
+	}
+
+	for _, transport := range idle {
+		closeIdleConnections(transport)
+	}
+}
+
+// Acquire picks a transport from the wrapped strategy.
+func (p *Pool) Acquire() (http.RoundTripper, error) {
+	return p.acquire(p.strategy.Acquire)
+}
+
+// AcquireRequest picks a transport for req from the wrapped strategy.
+func (p *Pool) AcquireRequest(req *http.Request) (http.RoundTripper, error) {
+	return p.acquire(func() (http.RoundTripper, error) { return p.adapted.AcquireRequest(req) })
+}
+
+// AcquireSkip picks a transport from the wrapped strategy that skip does not reject.
+func (p *Pool) AcquireSkip(req *http.Request, skip func(http.RoundTripper) bool) (http.RoundTripper, error) {
+	return p.acquire(func() (http.RoundTripper, error) { return acquireSkipping(p.strategy, req, skip) })
+}
+
+// Release hands the transport back to the wrapped strategy.
+func (p *Pool) Release(transport http.RoundTripper) {
+	p.strategy.Release(transport)
+	p.untrack(transport)
+}
+
+// ReleaseResult hands the transport back to the wrapped strategy.
+func (p *Pool) ReleaseResult(transport http.RoundTripper, result Result) {
+	p.adapted.ReleaseResult(transport, result)
+	p.untrack(transport)
+}
+
+// Stop stops watching proxy providers and waits for the watchers to exit. It
+// also stops the wrapped strategy, if it owns background goroutines.
+func (p *Pool) Stop() {
+	p.watchMutex.Lock()
+	for _, cancel := range p.watches {
+		cancel()
+	}
+	p.watches = nil
+	p.watchMutex.Unlock()
+
+	p.watchers.Wait()
+	stopStrategy(p.strategy)
+}
+
+// Transports returns the transports of the wrapped strategy, if it can list them.
+func (p *Pool) Transports() []http.RoundTripper {
+	if lister, ok := p.strategy.(TransportLister); ok {
+		return lister.Transports()
+	}
+	return nil
+}
+
+// acquire picks a transport with acquire and tracks it. A transport removed
+// between being picked and tracked may have been closed as idle already, so it
+// is handed back and another one is picked.
+func (p *Pool) acquire(acquire func() (http.RoundTripper, error)) (http.RoundTripper, error) {
+	for {
+		transport, err := acquire()
+		if err != nil {
+			return nil, err
+		}
+		if p.track(transport) {
+			return transport, nil
+		}
+		p.strategy.Release(transport)
+	}
+}
+
+// track counts an acquired transport as in flight, and reports whether it is
+// still in the pool. Transports are counted by their innermost roundtripper,
+// as created by the factory, since strategies may hand out wrappers.
+func (p *Pool) track(transport http.RoundTripper) bool {
+	transport = unwrapRoundTripper(transport)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.members[transport]; !ok {
+		return false
+	}
+	p.inFlight[transport]++
+	return true
+}
+
+// untrack counts a transport as no longer in flight, and closes it and forgets
+// its metrics when it was the last request of a removed transport.
+func (p *Pool) untrack(transport http.RoundTripper) {
+	transport = unwrapRoundTripper(transport)
+
+	p.mutex.Lock()
+	p.inFlight[transport]--
+	drained := p.inFlight[transport] <= 0
+	if drained {
+		delete(p.inFlight, transport)
+	}
+	_, member := p.members[transport]
+	removed := !member
+	if proxy, draining := p.draining[transport]; drained && draining {
+		delete(p.draining, transport)
+		p.forget(proxy)
+	}
+	p.mutex.Unlock()
+
+	if drained && removed {
+		closeIdleConnections(transport)
+	}
+}
+
+// forget drops the metrics of a removed proxy, unless another transport of
+// the pool, added back or still draining, carries the same label. It must be
+// called with the mutex held.
+func (p *Pool) forget(proxy string) {
+	forgetter, ok := p.cfg.Metrics.(MetricsForgetter)
+	if !ok {
+		return
+	}
+
+	for _, label := range p.members {
+		if label == proxy {
+			return
+		}
+	}
+	for _, label := range p.draining {
+		if label == proxy {
+			return
+		}
+	}
+
+	forgetter.Forget(proxy)
+}
+
+// proxyName returns the proxy of transport, with its password redacted.
+func (p *Pool) proxyName(transport http.RoundTripper) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.members[unwrapRoundTripper(transport)]
+}
+
+// closeIdleConnections closes the idle connections of transport, if it keeps any.
+func closeIdleConnections(transport http.RoundTripper) {
+	if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// setTransports hands entries to s, which must implement TransportSetter. It is
+// used by the strategy wrappers.
+func setTransports(s Strategy, entries []PoolEntry) {
+	setter, ok := s.(TransportSetter)
+	if !ok {
+		panic("wrapped strategy must implement TransportSetter")
+	}
+	setter.SetTransports(entries)
+}
+
+// listedTransports returns the set of transports s lists, or nil if it cannot
+// list them. Wrappers take it before locking their own mutex: listing takes
+// the lock of s, which s may hold while calling back into the wrapper.
+func listedTransports(s Strategy) map[http.RoundTripper]bool {
+	lister, ok := s.(TransportLister)
+	if !ok {
+		return nil
+	}
+
+	current := make(map[http.RoundTripper]bool)
+	for _, transport := range lister.Transports() {
+		current[transport] = true
+	}
+	return current
+}
+
+// retainTransports deletes the states of the transports not in current, as
+// returned by listedTransports. A nil current keeps every state.
+func retainTransports[V any](states map[http.RoundTripper]V, current map[http.RoundTripper]bool) {
+	if current == nil {
+		return
+	}
+
+	maps.DeleteFunc(states, func(transport http.RoundTripper, _ V) bool {
+		return !current[transport]
+	})
+}
+
+// OptPoolWithTransportFactory configures the factory creating the transports of added proxies.
+func OptPoolWithTransportFactory(factory func(string) (*http.Transport, error)) OptPool {
+	return func(cfg *PoolConfig) {
+		cfg.TransportFactory = factory
+	}
+}
+
+// OptPoolWithMetrics makes the pool forget the proxies it removes in metrics,
+// once their requests are done, if metrics implement MetricsForgetter. Pass
+// the metrics of the StrategyTransport wrapping the pool.
+func OptPoolWithMetrics(metrics Metrics) OptPool {
+	return func(cfg *PoolConfig) {
+		cfg.Metrics = metrics
+	}
+}
+
+// OptPoolWithLogger logs the proxies added to and removed from the pool, and
+// the failures of the proxy providers it watches.
+func OptPoolWithLogger(logger *slog.Logger) OptPool {
+	return func(cfg *PoolConfig) {
+		cfg.Logger = logger
+	}
+}
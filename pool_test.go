@@ -0,0 +1,297 @@
+package hacktheconn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingFactory creates direct transports and records them by proxy URL.
+type recordingFactory struct {
+	mutex      sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func (f *recordingFactory) create(proxy string) (*http.Transport, error) {
+	if proxy == "invalid://" {
+		return nil, errors.New("unsupported scheme")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.transports == nil {
+		f.transports = make(map[string]*http.Transport)
+	}
+	transport := &http.Transport{}
+	f.transports[proxy] = transport
+	return transport, nil
+}
+
+func (f *recordingFactory) get(proxy string) http.RoundTripper {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.transports[proxy]
+}
+
+func TestPoolAddRemoveReplace(t *testing.T) {
+	factory := &recordingFactory{}
+	pool := NewPool(NewRoundRobinStrategy(nil), OptPoolWithTransportFactory(factory.create))
+
+	_, err := pool.Acquire()
+	assert.ErrorIs(t, err, ErrNoTransports)
+
+	require.NoError(t, pool.Add("http://a:8080"))
+	require.NoError(t, pool.Add("http://b:8080?weight=3"))
+	require.NoError(t, pool.Add("http://a:8080"))
+	assert.Equal(t, []string{"http://a:8080", "http://b:8080"}, pool.Proxies())
+	assert.Len(t, pool.Transports(), 2)
+
+	require.NoError(t, pool.Remove("http://a:8080"))
+	assert.Equal(t, []http.RoundTripper{factory.get("http://b:8080")}, pool.Transports())
+	assert.ErrorIs(t, pool.Remove("http://a:8080"), ErrUnknownProxy)
+
+	b := factory.get("http://b:8080")
+	require.NoError(t, pool.Replace([]string{"http://c:8080", "http://b:8080"}))
+	assert.Equal(t, []string{"http://c:8080", "http://b:8080"}, pool.Proxies())
+	assert.Same(t, b, factory.get("http://b:8080"), "kept proxies keep their transport")
+
+	err = pool.Replace([]string{"http://d:8080", "invalid://"})
+	var proxyErr *ProxyError
+	require.ErrorAs(t, err, &proxyErr)
+	assert.Equal(t, "invalid://", proxyErr.Proxy)
+	assert.Equal(t, []string{"http://d:8080"}, pool.Proxies(), "invalid proxies are skipped")
+
+	assert.Error(t, pool.Replace([]string{"invalid://"}))
+	assert.Equal(t, []string{"http://d:8080"}, pool.Proxies(), "failed replace leaves the pool unchanged")
+}
+
+func TestPoolKeepsStateOfRemainingTransports(t *testing.T) {
+	factory := &recordingFactory{}
+	fh := NewFillHolesStrategy(nil)
+	pool := NewPool(fh, OptPoolWithTransportFactory(factory.create))
+	require.NoError(t, pool.Replace([]string{"http://a:8080", "http://b:8080"}))
+
+	for range 4 {
+		_, err := pool.Acquire()
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, pool.Add("http://c:8080"))
+	require.NoError(t, pool.Remove("http://a:8080"))
+	assert.Equal(t, []int{2, 0}, fh.requestCounts)
+
+	transport, err := pool.Acquire()
+	require.NoError(t, err)
+	assert.Same(t, factory.get("http://c:8080"), transport)
+}
+
+func TestPoolWeightedRoundRobin(t *testing.T) {
+	factory := &recordingFactory{}
+	pool := NewPool(NewWeightedRoundRobinStrategy(nil, nil), OptPoolWithTransportFactory(factory.create))
+	require.NoError(t, pool.Replace([]string{"http://a:8080?weight=3", "http://b:8080"}))
+
+	counts := make(map[http.RoundTripper]int)
+	for range 8 {
+		transport, err := pool.Acquire()
+		require.NoError(t, err)
+		counts[transport]++
+	}
+
+	assert.Equal(t, 6, counts[factory.get("http://a:8080")])
+	assert.Equal(t, 2, counts[factory.get("http://b:8080")])
+}
+
+func TestPoolWrappedStrategies(t *testing.T) {
+	strategies := map[string]Strategy{
+		"least response time": NewLeastResponseTimeStrategy(nil, time.Now, LeastResponseTimeLastResponseTimeCalculator),
+		"p2c":                 NewP2CStrategy(nil, P2CPeakEWMAScorer, 0.3, rand.NewPCG(1, 2)),
+		"consistent hash":     NewConsistentHashStrategy(nil, nil, ConsistentHashByHost, DefaultConsistentHashReplicas),
+		"circuit breaker":     NewCircuitBreakerStrategy(NewRoundRobinStrategy(nil)),
+		"outlier detection":   NewOutlierDetectionStrategy(NewRoundRobinStrategy(nil)),
+	}
+
+	for name, s := range strategies {
+		t.Run(name, func(t *testing.T) {
+			factory := &recordingFactory{}
+			pool := NewPool(s, OptPoolWithTransportFactory(factory.create))
+			require.NoError(t, pool.Replace([]string{"http://a:8080", "http://b:8080"}))
+			require.NoError(t, pool.Remove("http://a:8080"))
+
+			for range 5 {
+				transport, err := pool.Acquire()
+				require.NoError(t, err)
+				assert.Same(t, factory.get("http://b:8080"), unwrapRoundTripper(transport))
+				pool.Release(transport)
+			}
+		})
+	}
+}
+
+func TestPoolDrainsRemovedTransports(t *testing.T) {
+	var closed atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	pool := NewPool(NewRoundRobinStrategy(nil), OptPoolWithTransportFactory(DirectTransportFactory))
+	require.NoError(t, pool.Add("direct://"))
+	client := &http.Client{Transport: Transport(pool)}
+
+	res, err := client.Get(server.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, pool.Remove("direct://"))
+	_, err = client.Get(server.URL)
+	assert.ErrorIs(t, err, ErrNoTransports)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Zero(t, closed.Load(), "in-flight request must not be cut")
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, "ok", string(body))
+
+	assert.Eventually(t, func() bool { return closed.Load() == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestPoolConcurrentChanges(t *testing.T) {
+	factory := &recordingFactory{}
+	pool := NewPool(NewFillHolesStrategy(nil), OptPoolWithTransportFactory(factory.create))
+	proxies := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+	require.NoError(t, pool.Replace(proxies))
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 200 {
+				if i == 0 && j%10 == 0 {
+					_ = pool.Replace(proxies[:1+j%3])
+					continue
+				}
+				if transport, err := pool.Acquire(); err == nil {
+					pool.Release(transport)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Empty(t, pool.inFlight)
+}
+
+func TestPoolReplaceWrappedStrategiesUnderLoad(t *testing.T) {
+	probe := func(context.Context, http.RoundTripper) error { return nil }
+	wrappers := map[string]func(Strategy) Strategy{
+		"circuit breaker":   func(s Strategy) Strategy { return NewCircuitBreakerStrategy(s) },
+		"outlier detection": func(s Strategy) Strategy { return NewOutlierDetectionStrategy(s) },
+		"health check": func(s Strategy) Strategy {
+			return NewHealthCheckStrategy(s, probe, OptHealthCheckWithInterval(time.Millisecond, 0))
+		},
+	}
+
+	for name, wrap := range wrappers {
+		t.Run(name, func(t *testing.T) {
+			factory := &recordingFactory{}
+			pool := NewPool(wrap(NewFillHolesStrategy(nil)), OptPoolWithTransportFactory(factory.create))
+			defer pool.Stop()
+
+			proxies := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+			require.NoError(t, pool.Replace(proxies))
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+
+				var (
+					wg       sync.WaitGroup
+					replaced atomic.Bool
+				)
+				for range 8 {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for !replaced.Load() {
+							if transport, err := pool.Acquire(); err == nil {
+								pool.ReleaseResult(transport, Result{StatusCode: http.StatusOK})
+							}
+						}
+					}()
+				}
+				for i := range 1000 {
+					_ = pool.Replace(proxies[:1+i%3])
+				}
+				replaced.Store(true)
+				wg.Wait()
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("replacing the proxies deadlocked with requests in flight")
+			}
+		})
+	}
+}
+
+// pausingStrategy pauses its first acquisition once the transport is picked.
+type pausingStrategy struct {
+	*RoundRobinStrategy
+	once           sync.Once
+	picked, resume chan struct{}
+}
+
+func (s *pausingStrategy) Acquire() (http.RoundTripper, error) {
+	transport, err := s.RoundRobinStrategy.Acquire()
+	s.once.Do(func() {
+		close(s.picked)
+		<-s.resume
+	})
+	return transport, err
+}
+
+func TestPoolSkipsTransportsRemovedWhileAcquired(t *testing.T) {
+	s := &pausingStrategy{
+		RoundRobinStrategy: NewRoundRobinStrategy(nil),
+		picked:             make(chan struct{}),
+		resume:             make(chan struct{}),
+	}
+	factory := &recordingFactory{}
+	pool := NewPool(s, OptPoolWithTransportFactory(factory.create))
+	require.NoError(t, pool.Add("http://a:8080"))
+
+	acquired := make(chan error)
+	go func() {
+		_, err := pool.Acquire()
+		acquired <- err
+	}()
+
+	<-s.picked
+	require.NoError(t, pool.Replace(nil))
+	close(s.resume)
+
+	assert.ErrorIs(t, <-acquired, ErrNoTransports)
+	assert.Empty(t, pool.inFlight)
+}
@@ -0,0 +1,263 @@
+package hacktheconn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProvider supplies the proxy list of a Pool, e.g. from a file or a
+// vendor endpoint, as watched by Pool.Watch.
+type ProxyProvider interface {
+	// Proxies returns the current proxy list.
+	Proxies(ctx context.Context) ([]string, error)
+}
+
+// Watch replaces the proxies of the pool with the ones of provider right away,
+// and then at every interval until ctx is done or Stop is called, as Replace
+// does: invalid proxies are skipped. It returns the error of the first load.
+// Later errors are passed to onError, if not nil. A provider failing, or
+// returning an empty list or only invalid proxies, leaves the proxies
+// unchanged. A non-positive interval fails with ErrBadInterval, without
+// loading or watching the provider.
+func (p *Pool) Watch(ctx context.Context, provider ProxyProvider, interval time.Duration, onError func(error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("watching proxy provider: %w", ErrBadInterval)
+	}
+
+	err := p.load(ctx, provider)
+
+	ctx, cancel := context.WithCancel(ctx)
+	p.watchMutex.Lock()
+	p.watches = append(p.watches, cancel)
+	p.watchers.Add(1)
+	p.watchMutex.Unlock()
+
+	go func() {
+		defer p.watchers.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := p.load(ctx, provider); err != nil && ctx.Err() == nil {
+					p.logger.Warn("loading proxies failed", "error", err)
+					if onError != nil {
+						onError(err)
+					}
+				}
+			}
+		}
+	}()
+
+	return err
+}
+
+// load replaces the proxies of the pool with the ones of provider.
+func (p *Pool) load(ctx context.Context, provider ProxyProvider) error {
+	proxies, err := provider.Proxies(ctx)
+	if err != nil {
+		return fmt.Errorf("loading proxies: %w", err)
+	}
+	if len(proxies) == 0 {
+		return ErrNoProxies
+	}
+
+	return p.Replace(proxies)
+}
+
+// parseProxyList parses a proxy list, either a JSON array of proxy URLs, a
+// JSON object holding that array under "proxies", or one proxy URL per line.
+// Blank lines and lines starting with # are ignored.
+func parseProxyList(data []byte) ([]string, error) {
+	data = bytes.TrimSpace(data)
+
+	switch {
+	case bytes.HasPrefix(data, []byte("[")):
+		var proxies []string
+		if err := json.Unmarshal(data, &proxies); err != nil {
+			return nil, fmt.Errorf("parsing proxy list: %w", err)
+		}
+		return proxies, nil
+	case bytes.HasPrefix(data, []byte("{")):
+		var list struct {
+			Proxies []string `json:"proxies"`
+		}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("parsing proxy list: %w", err)
+		}
+		return list.Proxies, nil
+	}
+
+	var proxies []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		proxies = append(proxies, line)
+	}
+	return proxies, nil
+}
+
+// FileProxyProvider reads the proxy list from a file, holding either one
+// proxy URL per line or a JSON list. The file is only read again once its
+// modification time or size changes.
+type FileProxyProvider struct {
+	path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	proxies []string
+}
+
+// NewFileProxyProvider creates a provider reading the proxy list at path.
+func NewFileProxyProvider(path string) *FileProxyProvider {
+	return &FileProxyProvider{path: path}
+}
+
+// Proxies returns the proxy list of the file, reloading it if it changed.
+func (f *FileProxyProvider) Proxies(context.Context) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.proxies != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.proxies, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	proxies, err := parseProxyList(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.proxies = proxies
+
+	return proxies, nil
+}
+
+// HTTPProxyProvider fetches the proxy list from an HTTP endpoint, returning
+// either one proxy URL per line or a JSON list. It revalidates the list with
+// the ETag of the previous response, if any.
+type HTTPProxyProvider struct {
+	url    string
+	client *http.Client
+
+	mutex   sync.Mutex
+	etag    string
+	proxies []string
+}
+
+// NewHTTPProxyProvider creates a provider fetching the proxy list from url
+// with client, or http.DefaultClient if nil. The client should not route
+// through the pool it feeds.
+func NewHTTPProxyProvider(url string, client *http.Client) *HTTPProxyProvider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &HTTPProxyProvider{url: url, client: client}
+}
+
+// Proxies fetches the proxy list from the endpoint.
+func (h *HTTPProxyProvider) Proxies(ctx context.Context) ([]string, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.etag != "" {
+		req.Header.Set("If-None-Match", h.etag)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified && h.proxies != nil {
+		return h.proxies, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching proxy list: unexpected status %s", res.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, 10<<20))
+	if err != nil {
+		return nil, fmt.Errorf("fetching proxy list: %w", err)
+	}
+
+	proxies, err := parseProxyList(data)
+	if err != nil {
+		return nil, err
+	}
+
+	h.etag = res.Header.Get("ETag")
+	h.proxies = proxies
+
+	return proxies, nil
+}
+
+// DefaultProxyEnvVars are the environment variables read by EnvProxyProvider
+// when none are given.
+var DefaultProxyEnvVars = []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "ALL_PROXY", "all_proxy"}
+
+// EnvProxyProvider reads the proxy list from environment variables, each
+// holding one or more proxy URLs separated by commas or spaces.
+type EnvProxyProvider struct {
+	names []string
+}
+
+// NewEnvProxyProvider creates a provider reading the given environment
+// variables, or DefaultProxyEnvVars if none are given.
+func NewEnvProxyProvider(names ...string) *EnvProxyProvider {
+	if len(names) == 0 {
+		names = DefaultProxyEnvVars
+	}
+
+	return &EnvProxyProvider{names: names}
+}
+
+// Proxies returns the proxies of all the variables, without duplicates.
+func (e *EnvProxyProvider) Proxies(context.Context) ([]string, error) {
+	var proxies []string
+	seen := make(map[string]bool)
+
+	for _, name := range e.names {
+		for _, proxy := range strings.FieldsFunc(os.Getenv(name), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n'
+		}) {
+			if !seen[proxy] {
+				seen[proxy] = true
+				proxies = append(proxies, proxy)
+			}
+		}
+	}
+
+	return proxies, nil
+}
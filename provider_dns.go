@@ -0,0 +1,204 @@
+package hacktheconn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSResolver resolves the records used by DNS discovery. *net.Resolver
+// implements it.
+type DNSResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSProxyProvider discovers the backends behind a hostname through DNS and
+// returns one pinned direct proxy URL per address, e.g. "direct://10.0.0.1:443",
+// for which DefaultTransportFactory creates a PinnedDirectTransport. Watched by
+// a Pool, it adds and removes transports as the records change.
+type DNSProxyProvider struct {
+	cfg    DNSDiscoveryConfig
+	lookup func(context.Context) ([]string, error)
+}
+
+type (
+	// OptDNSDiscovery configures DNS discovery.
+	OptDNSDiscovery = Option[DNSDiscoveryConfig]
+
+	DNSDiscoveryConfig struct {
+		// Resolver resolves the records. Defaults to net.DefaultResolver.
+		Resolver DNSResolver
+		// TTL is how long resolved records are used before resolving them
+		// again, as the resolver of the standard library does not expose
+		// record TTLs. Defaults to 30s.
+		TTL time.Duration
+		// Network is "ip4" or "ip6" to only keep addresses of that family, or
+		// "ip" to keep both, which is the default.
+		Network string
+	}
+)
+
+func newDNSDiscoveryConfig(opts []OptDNSDiscovery) DNSDiscoveryConfig {
+	cfg := DNSDiscoveryConfig{
+		Resolver: net.DefaultResolver,
+		TTL:      30 * time.Second,
+		Network:  "ip",
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return cfg
+}
+
+// NewDNSProxyProvider discovers the A and AAAA records of host, which may
+// carry a port, as in "api.example.com:443". Without a port, transports
+// connect to the port of each request.
+func NewDNSProxyProvider(host string, opts ...OptDNSDiscovery) *DNSProxyProvider {
+	d := &DNSProxyProvider{cfg: newDNSDiscoveryConfig(opts)}
+
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		name, port = h, p
+	}
+
+	d.lookup = func(ctx context.Context) ([]string, error) {
+		ips, err := d.lookupIPs(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		proxies := make([]string, len(ips))
+		for i, ip := range ips {
+			proxies[i] = pinnedDirectURL(ip, port, 0)
+		}
+		return proxies, nil
+	}
+
+	return d
+}
+
+// NewSRVProxyProvider discovers the SRV records of the given service, e.g.
+// "http", "tcp" and "example.com" for _http._tcp.example.com, and the
+// addresses of their targets. Only the records of the lowest priority are
+// used, and their weights are carried in the weight query parameter of the
+// proxy URLs, for WeightedRoundRobinStrategy.
+func NewSRVProxyProvider(service, proto, name string, opts ...OptDNSDiscovery) *DNSProxyProvider {
+	d := &DNSProxyProvider{cfg: newDNSDiscoveryConfig(opts)}
+
+	d.lookup = func(ctx context.Context) ([]string, error) {
+		_, records, err := d.cfg.Resolver.LookupSRV(ctx, service, proto, name)
+		if err != nil {
+			return nil, fmt.Errorf("resolving SRV records of %s: %w", name, err)
+		}
+		if len(records) == 0 {
+			return nil, nil
+		}
+
+		priority := slices.MinFunc(records, func(a, b *net.SRV) int {
+			return int(a.Priority) - int(b.Priority)
+		}).Priority
+
+		var proxies []string
+		for _, record := range records {
+			if record.Priority != priority {
+				continue
+			}
+
+			ips, err := d.lookupIPs(ctx, strings.TrimSuffix(record.Target, "."))
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				proxies = append(proxies, pinnedDirectURL(ip, strconv.Itoa(int(record.Port)), int(record.Weight)))
+			}
+		}
+		return proxies, nil
+	}
+
+	return d
+}
+
+// Proxies resolves the records and returns a pinned direct proxy URL per
+// address, sorted so that unchanged records yield the same list.
+func (d *DNSProxyProvider) Proxies(ctx context.Context) ([]string, error) {
+	proxies, err := d.lookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(proxies)
+	return slices.Compact(proxies), nil
+}
+
+// TTL returns how long resolved records are used, to be given as the interval
+// of Pool.Watch.
+func (d *DNSProxyProvider) TTL() time.Duration {
+	return d.cfg.TTL
+}
+
+// lookupIPs resolves host, keeping the addresses of the configured network.
+func (d *DNSProxyProvider) lookupIPs(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := d.cfg.Resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", host, err)
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		isIPv4 := addr.IP.To4() != nil
+		if (d.cfg.Network == "ip4" && !isIPv4) || (d.cfg.Network == "ip6" && isIPv4) {
+			continue
+		}
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// pinnedDirectURL returns the proxy URL of a direct transport pinned to ip and
+// port, if not empty, with weight, if positive.
+func pinnedDirectURL(ip net.IP, port string, weight int) string {
+	host := ip.String()
+	switch {
+	case port != "":
+		host = net.JoinHostPort(host, port)
+	case ip.To4() == nil:
+		host = "[" + host + "]"
+	}
+
+	proxy := "direct://" + host
+	if weight > 0 {
+		proxy += "?weight=" + strconv.Itoa(weight)
+	}
+	return proxy
+}
+
+// OptDNSDiscoveryWithResolver configures the resolver, e.g. a net.Resolver
+// querying a given server, or a fake in tests.
+func OptDNSDiscoveryWithResolver(resolver DNSResolver) OptDNSDiscovery {
+	return func(cfg *DNSDiscoveryConfig) {
+		cfg.Resolver = resolver
+	}
+}
+
+// OptDNSDiscoveryWithTTL configures how long resolved records are used before
+// resolving them again.
+func OptDNSDiscoveryWithTTL(ttl time.Duration) OptDNSDiscovery {
+	return func(cfg *DNSDiscoveryConfig) {
+		cfg.TTL = ttl
+	}
+}
+
+// OptDNSDiscoveryWithNetwork keeps only IPv4 addresses with "ip4", or only
+// IPv6 addresses with "ip6".
+func OptDNSDiscoveryWithNetwork(network string) OptDNSDiscovery {
+	return func(cfg *DNSDiscoveryConfig) {
+		cfg.Network = network
+	}
+}
@@ -0,0 +1,140 @@
+package hacktheconn
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver serves DNS records from memory.
+type fakeResolver struct {
+	mutex sync.Mutex
+	ips   map[string][]string
+	srv   map[string][]*net.SRV
+}
+
+func (f *fakeResolver) setIPs(host string, ips ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.ips[host] = ips
+}
+
+func (f *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ips, ok := f.ips[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs, nil
+}
+
+func (f *fakeResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	cname := "_" + service + "._" + proto + "." + name
+	return cname, f.srv[cname], nil
+}
+
+func TestDNSProxyProvider(t *testing.T) {
+	resolver := &fakeResolver{ips: map[string][]string{
+		"api.example.com": {"10.0.0.2", "10.0.0.1", "2001:db8::1"},
+	}}
+
+	proxies, err := NewDNSProxyProvider("api.example.com:443", OptDNSDiscoveryWithResolver(resolver)).
+		Proxies(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"direct://10.0.0.1:443", "direct://10.0.0.2:443", "direct://[2001:db8::1]:443"}, proxies)
+
+	proxies, err = NewDNSProxyProvider("api.example.com",
+		OptDNSDiscoveryWithResolver(resolver),
+		OptDNSDiscoveryWithNetwork("ip6"),
+	).Proxies(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"direct://[2001:db8::1]"}, proxies)
+
+	_, err = NewDNSProxyProvider("missing.example.com", OptDNSDiscoveryWithResolver(resolver)).
+		Proxies(context.Background())
+	assert.Error(t, err)
+}
+
+func TestSRVProxyProvider(t *testing.T) {
+	resolver := &fakeResolver{
+		ips: map[string][]string{
+			"a.example.com": {"10.0.0.1"},
+			"b.example.com": {"10.0.0.2"},
+			"c.example.com": {"10.0.0.3"},
+		},
+		srv: map[string][]*net.SRV{
+			"_http._tcp.example.com": {
+				{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 3},
+				{Target: "b.example.com.", Port: 8081, Priority: 10, Weight: 1},
+				{Target: "c.example.com.", Port: 8082, Priority: 20, Weight: 1},
+			},
+		},
+	}
+
+	proxies, err := NewSRVProxyProvider("http", "tcp", "example.com", OptDNSDiscoveryWithResolver(resolver)).
+		Proxies(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"direct://10.0.0.1:8080?weight=3", "direct://10.0.0.2:8081?weight=1"}, proxies)
+}
+
+func TestPinnedDirectTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Host)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	transport, err := DefaultTransportFactory("direct://" + serverURL.Host)
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: transport}
+	res, err := client.Get("http://backend.invalid/")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, "backend.invalid", string(body), "the request keeps its host")
+}
+
+func TestDNSDiscoveryFollowsRecords(t *testing.T) {
+	resolver := &fakeResolver{ips: map[string][]string{"api.example.com": {"10.0.0.1", "10.0.0.2"}}}
+	provider := NewDNSProxyProvider("api.example.com:443",
+		OptDNSDiscoveryWithResolver(resolver),
+		OptDNSDiscoveryWithTTL(5*time.Millisecond),
+	)
+
+	pool := NewPool(NewRoundRobinStrategy(nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, pool.Watch(ctx, provider, provider.TTL(), nil))
+	assert.Equal(t, []string{"direct://10.0.0.1:443", "direct://10.0.0.2:443"}, pool.Proxies())
+
+	resolver.setIPs("api.example.com", "10.0.0.2", "10.0.0.3")
+	assert.Eventually(t, func() bool {
+		proxies := pool.Proxies()
+		return len(proxies) == 2 && proxies[1] == "direct://10.0.0.3:443"
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,191 @@
+package hacktheconn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticProvider returns a proxy list that can be changed by tests.
+type staticProvider struct {
+	mutex   sync.Mutex
+	proxies []string
+	err     error
+}
+
+func (s *staticProvider) set(proxies []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.proxies, s.err = proxies, err
+}
+
+func (s *staticProvider) Proxies(context.Context) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.proxies, s.err
+}
+
+func TestParseProxyList(t *testing.T) {
+	tests := map[string]string{
+		"lines":       "http://a:8080\n\n# comment\n  socks5://b:1080  \n",
+		"json array":  `["http://a:8080", "socks5://b:1080"]`,
+		"json object": `{"proxies": ["http://a:8080", "socks5://b:1080"]}`,
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			proxies, err := parseProxyList([]byte(data))
+			require.NoError(t, err)
+			assert.Equal(t, []string{"http://a:8080", "socks5://b:1080"}, proxies)
+		})
+	}
+
+	_, err := parseProxyList([]byte(`["http://a:8080"`))
+	assert.Error(t, err)
+}
+
+func TestFileProxyProviderReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxies.txt")
+	require.NoError(t, os.WriteFile(path, []byte("http://a:8080\n"), 0o600))
+
+	provider := NewFileProxyProvider(path)
+	proxies, err := provider.Proxies(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://a:8080"}, proxies)
+
+	require.NoError(t, os.WriteFile(path, []byte(`["http://a:8080", "http://b:8080"]`), 0o600))
+	proxies, err = provider.Proxies(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://a:8080", "http://b:8080"}, proxies)
+
+	require.NoError(t, os.Remove(path))
+	_, err = provider.Proxies(context.Background())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestHTTPProxyProvider(t *testing.T) {
+	var requests, notModified atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, "http://a:8080\nhttp://b:8080\n")
+	}))
+	defer server.Close()
+
+	provider := NewHTTPProxyProvider(server.URL, server.Client())
+	for range 2 {
+		proxies, err := provider.Proxies(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"http://a:8080", "http://b:8080"}, proxies)
+	}
+	assert.Equal(t, int64(2), requests.Load())
+	assert.Equal(t, int64(1), notModified.Load())
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	_, err := NewHTTPProxyProvider(failing.URL, nil).Proxies(context.Background())
+	assert.Error(t, err)
+}
+
+func TestEnvProxyProvider(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://a:8080")
+	t.Setenv("https_proxy", "http://a:8080")
+	t.Setenv("HTTP_PROXY", "")
+	t.Setenv("http_proxy", "")
+	t.Setenv("ALL_PROXY", "")
+	t.Setenv("all_proxy", "")
+	t.Setenv("VENDOR_PROXIES", "http://b:8080, socks5://c:1080")
+
+	proxies, err := NewEnvProxyProvider().Proxies(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://a:8080"}, proxies)
+
+	proxies, err = NewEnvProxyProvider("VENDOR_PROXIES").Proxies(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://b:8080", "socks5://c:1080"}, proxies)
+}
+
+func TestPoolWatch(t *testing.T) {
+	provider := &staticProvider{proxies: []string{"http://a:8080"}}
+	pool := NewPool(NewRoundRobinStrategy(nil), OptPoolWithTransportFactory((&recordingFactory{}).create))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lastErr atomic.Pointer[error]
+	require.NoError(t, pool.Watch(ctx, provider, 5*time.Millisecond, func(err error) {
+		lastErr.Store(&err)
+	}))
+	assert.Equal(t, []string{"http://a:8080"}, pool.Proxies())
+
+	provider.set([]string{"http://b:8080", "http://c:8080"}, nil)
+	assert.Eventually(t, func() bool { return len(pool.Proxies()) == 2 }, time.Second, time.Millisecond)
+
+	provider.set(nil, nil)
+	assert.Eventually(t, func() bool {
+		err := lastErr.Load()
+		return err != nil && errors.Is(*err, ErrNoProxies)
+	}, time.Second, time.Millisecond)
+
+	vendorDown := errors.New("vendor down")
+	provider.set(nil, vendorDown)
+	assert.Eventually(t, func() bool {
+		err := lastErr.Load()
+		return err != nil && errors.Is(*err, vendorDown)
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"http://b:8080", "http://c:8080"}, pool.Proxies(), "errors keep the proxies")
+}
+
+func TestPoolWatchBadInterval(t *testing.T) {
+	provider := &staticProvider{proxies: []string{"http://a:8080"}}
+	pool := NewPool(NewRoundRobinStrategy(nil), OptPoolWithTransportFactory((&recordingFactory{}).create))
+
+	assert.ErrorIs(t, pool.Watch(context.Background(), provider, 0, nil), ErrBadInterval)
+	assert.Empty(t, pool.Proxies())
+
+	_, err := NewRoundRobin(nil, OptRoundRobinWithProxyProvider(provider, -time.Second))
+	assert.ErrorIs(t, err, ErrBadInterval)
+	assert.Panics(t, func() { TransportFillHoles(nil, OptFillHolesWithProxyProvider(provider, 0)) })
+}
+
+func TestTransportRoundRobinWithProxyProvider(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	path := filepath.Join(t.TempDir(), "proxies.txt")
+	require.NoError(t, os.WriteFile(path, []byte("direct://\n"), 0o600))
+
+	client := &http.Client{
+		Transport: TransportRoundRobin(nil, OptRoundRobinWithProxyProvider(NewFileProxyProvider(path), time.Minute)),
+	}
+
+	res, err := client.Get(target.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, "ok", string(body))
+}
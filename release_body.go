@@ -0,0 +1,95 @@
+package hacktheconn
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// releaseBody wraps a response body and invokes onRelease exactly once, as soon
+// as the body is fully read, fails, or is closed by the caller.
+type releaseBody struct {
+	body      io.ReadCloser
+	bytesRead atomic.Int64
+	once      sync.Once
+	onRelease func(bytesRead int64, err error)
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.bytesRead.Add(int64(n))
+
+	switch {
+	case err == io.EOF:
+		b.release(nil)
+	case err != nil:
+		b.release(err)
+	}
+
+	return n, err
+}
+
+func (b *releaseBody) Close() error {
+	err := b.body.Close()
+	b.release(err)
+	return err
+}
+
+func (b *releaseBody) release(err error) {
+	b.once.Do(func() {
+		b.onRelease(b.bytesRead.Load(), err)
+	})
+}
+
+// releaseReadWriteBody preserves io.Writer on bodies of upgraded connections
+// (101 Switching Protocols), which net/http hands out as io.ReadWriteCloser.
+type releaseReadWriteBody struct {
+	*releaseBody
+}
+
+func (b releaseReadWriteBody) Write(p []byte) (int, error) {
+	return b.body.(io.Writer).Write(p)
+}
+
+// wrapResponseBody replaces res.Body so that onRelease runs once the body is
+// done with. Responses without a body are released immediately.
+func wrapResponseBody(res *http.Response, onRelease func(bytesRead int64, err error)) {
+	if res.Body == nil {
+		onRelease(0, nil)
+		return
+	}
+
+	body := &releaseBody{body: res.Body, onRelease: onRelease}
+	if _, ok := res.Body.(io.Writer); ok {
+		res.Body = releaseReadWriteBody{body}
+		return
+	}
+
+	res.Body = body
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	count *atomic.Int64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.count.Add(int64(n))
+	return n, err
+}
+
+// countRequestBody returns a shallow copy of req whose body counts the bytes
+// sent by the transport. Requests without a body are returned as is.
+func countRequestBody(req *http.Request) (*http.Request, *atomic.Int64) {
+	count := new(atomic.Int64)
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, count
+	}
+
+	counted := *req
+	counted.Body = countingBody{ReadCloser: req.Body, count: count}
+	return &counted, count
+}
@@ -0,0 +1,237 @@
+package hacktheconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy configures retries of failed requests on different transports.
+// Zero fields take their documented defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// Defaults to 3.
+	MaxAttempts int
+	// BaseBackoff is the delay before the first retry, doubled on every retry
+	// up to MaxBackoff. The actual delay is randomized between zero and that
+	// value (full jitter). Defaults to 50ms and 1s.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// ShouldRetry tells whether an attempt failed and may be retried. Defaults
+	// to DefaultShouldRetry.
+	ShouldRetry func(*http.Response, error) bool
+	// Budget caps the number of retries across all requests. Nil means no cap.
+	Budget *RetryBudget
+}
+
+// DefaultShouldRetry retries transport errors, except cancellations by the
+// caller, and 502, 503 and 504 responses.
+func DefaultShouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.BaseBackoff <= 0 {
+		p.BaseBackoff = 50 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Second
+	}
+	if p.ShouldRetry == nil {
+		p.ShouldRetry = DefaultShouldRetry
+	}
+	return p
+}
+
+// backoff returns the randomized delay before the given retry, starting at 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseBackoff << (retry - 1)
+	if delay <= 0 || delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return rand.N(delay + 1)
+}
+
+// RetryBudget is a token bucket that keeps retries from amplifying an outage.
+// Every request deposits ratio tokens and every retry withdraws one, so that
+// retries stay below ratio of the requests once the initial tokens run out.
+type RetryBudget struct {
+	ratio     float64
+	maxTokens float64
+
+	mutex  sync.Mutex
+	tokens float64
+}
+
+// NewRetryBudget creates a retry budget allowing retries for ratio of the
+// requests, e.g. 0.1 for 10%, holding up to maxTokens retries. It starts full.
+func NewRetryBudget(ratio, maxTokens float64) *RetryBudget {
+	if ratio < 0 {
+		panic("ratio must not be negative")
+	}
+	if maxTokens < 1 {
+		panic("maxTokens must be at least 1")
+	}
+
+	return &RetryBudget{
+		ratio:     ratio,
+		maxTokens: maxTokens,
+		tokens:    maxTokens,
+	}
+}
+
+func (b *RetryBudget) deposit() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens = min(b.tokens+b.ratio, b.maxTokens)
+}
+
+func (b *RetryBudget) withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RetryError is returned when every attempt of a request failed. It holds the
+// error of each attempt, in order.
+type RetryError struct {
+	Attempts []error
+}
+
+func (e *RetryError) Error() string {
+	messages := make([]string, len(e.Attempts))
+	for i, err := range e.Attempts {
+		messages[i] = fmt.Sprintf("attempt %d: %v", i+1, err)
+	}
+	return fmt.Sprintf("all %d attempts failed: %s", len(e.Attempts), strings.Join(messages, "; "))
+}
+
+func (e *RetryError) Unwrap() []error {
+	return e.Attempts
+}
+
+// isIdempotent reports whether req may be sent more than once: its method is
+// idempotent or it carries an idempotency key.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+// isReplayable reports whether the body of req can be sent again.
+func isReplayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// roundTripWithRetries executes the request, retrying failed attempts on
+// transports that were not tried yet as long as the policy and budget allow it.
+func (t *StrategyTransport) roundTripWithRetries(req *http.Request, policy *RetryPolicy) (*http.Response, error) {
+	p := policy.withDefaults()
+	if p.Budget != nil {
+		p.Budget.deposit()
+	}
+
+	retryable := isIdempotent(req) && isReplayable(req)
+	tried := make(map[http.RoundTripper]bool)
+	var attempts []error
+
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 {
+			var err error
+			if attemptReq, err = rewindBody(req); err != nil {
+				return nil, &RetryError{Attempts: append(attempts, err)}
+			}
+		}
+
+		transport, err := t.acquireSkipping(attemptReq, func(rt http.RoundTripper) bool { return tried[rt] })
+		if err != nil {
+			if len(attempts) == 0 {
+				return nil, err
+			}
+			return nil, &RetryError{Attempts: append(attempts, err)}
+		}
+		tried[transport] = true
+
+		res, err := t.roundTrip(attemptReq, transport)
+
+		last := !retryable || attempt >= p.MaxAttempts || !p.ShouldRetry(res, err)
+		if !last && p.Budget != nil && !p.Budget.withdraw() {
+			last = true
+		}
+
+		if last {
+			if err != nil && len(attempts) > 0 {
+				return nil, &RetryError{Attempts: append(attempts, err)}
+			}
+			return res, err
+		}
+
+		if err == nil {
+			err = fmt.Errorf("unexpected status %s", res.Status)
+			_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+			_ = res.Body.Close()
+		}
+		attempts = append(attempts, err)
+
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, &RetryError{Attempts: append(attempts, req.Context().Err())}
+		case <-timer.C:
+		}
+	}
+}
+
+// rewindBody returns a shallow copy of req with a fresh body to send it again.
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("rewinding request body: %w", err)
+	}
+
+	rewound := *req
+	rewound.Body = body
+	return &rewound, nil
+}
+
+// OptStrategyTransportWithRetry enables retries of failed requests on different
+// transports. Only idempotent requests, by method or Idempotency-Key header,
+// whose body can be replayed through GetBody are retried.
+func OptStrategyTransportWithRetry(policy RetryPolicy) OptStrategyTransport {
+	return func(cfg *StrategyTransportConfig) {
+		cfg.retry = &policy
+	}
+}
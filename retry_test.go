@@ -0,0 +1,153 @@
+package hacktheconn
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedTransport answers with a fixed status, or fails when status is 0,
+// and records the request bodies it receives.
+type scriptedTransport struct {
+	ID     string
+	status int
+
+	mutex  sync.Mutex
+	bodies []string
+}
+
+func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		data, _ := io.ReadAll(req.Body)
+		body = string(data)
+	}
+
+	s.mutex.Lock()
+	s.bodies = append(s.bodies, body)
+	s.mutex.Unlock()
+
+	if s.status == 0 {
+		return nil, errors.New("proxy " + s.ID + " refused connection")
+	}
+	return &http.Response{
+		StatusCode: s.status,
+		Status:     http.StatusText(s.status),
+		Body:       io.NopCloser(strings.NewReader(s.ID)),
+	}, nil
+}
+
+func (s *scriptedTransport) calls() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.bodies)
+}
+
+var fastRetries = RetryPolicy{BaseBackoff: time.Microsecond, MaxBackoff: time.Microsecond}
+
+func TestRetryOnDifferentTransport(t *testing.T) {
+	a := &scriptedTransport{ID: "A"}
+	b := &scriptedTransport{ID: "B", status: http.StatusServiceUnavailable}
+	c := &scriptedTransport{ID: "C", status: http.StatusOK}
+
+	s := NewFillHolesStrategy([]http.RoundTripper{a, b, c})
+	tr := Transport(s, OptStrategyTransportWithRetry(fastRetries))
+
+	req, _ := http.NewRequest(http.MethodPut, "http://example.com", strings.NewReader("payload"))
+	res, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	assert.Equal(t, "C", string(data))
+	assert.Equal(t, []string{"payload"}, a.bodies)
+	assert.Equal(t, []string{"payload"}, b.bodies)
+	assert.Equal(t, []string{"payload"}, c.bodies)
+	assert.Equal(t, []int{0, 0, 0}, s.requestCounts)
+}
+
+func TestRetryReportsEveryAttempt(t *testing.T) {
+	transports := []http.RoundTripper{
+		&scriptedTransport{ID: "A"},
+		&scriptedTransport{ID: "B"},
+	}
+	tr := Transport(NewRoundRobinStrategy(transports), OptStrategyTransportWithRetry(fastRetries))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	_, err := tr.RoundTrip(req)
+
+	var retryErr *RetryError
+	require.ErrorAs(t, err, &retryErr)
+	require.Len(t, retryErr.Attempts, 3)
+	assert.Contains(t, retryErr.Attempts[0].Error(), "proxy A")
+	assert.Contains(t, retryErr.Attempts[1].Error(), "proxy B")
+	// With every transport tried, the last attempt reuses one.
+	assert.Contains(t, retryErr.Attempts[2].Error(), "proxy")
+	assert.Contains(t, err.Error(), "all 3 attempts failed")
+}
+
+func TestRetryOnlyIdempotentRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		header  string
+		body    io.Reader
+		retried bool
+	}{
+		{name: "GET", method: http.MethodGet, retried: true},
+		{name: "POST", method: http.MethodPost, body: strings.NewReader("x"), retried: false},
+		{name: "POST with idempotency key", method: http.MethodPost, header: "key", body: strings.NewReader("x"), retried: true},
+		{name: "PUT without GetBody", method: http.MethodPut, body: io.NopCloser(strings.NewReader("x")), retried: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &scriptedTransport{ID: "A"}
+			b := &scriptedTransport{ID: "B", status: http.StatusOK}
+			tr := Transport(NewRoundRobinStrategy([]http.RoundTripper{a, b}), OptStrategyTransportWithRetry(fastRetries))
+
+			req, _ := http.NewRequest(tt.method, "http://example.com", tt.body)
+			if tt.header != "" {
+				req.Header.Set("Idempotency-Key", tt.header)
+			}
+
+			_, err := tr.RoundTrip(req)
+			assert.Equal(t, tt.retried, err == nil)
+			assert.Equal(t, tt.retried, b.calls() == 1)
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(0.5, 1)
+	policy := fastRetries
+	policy.MaxAttempts = 2
+	policy.Budget = budget
+
+	a := &scriptedTransport{ID: "A"}
+	b := &scriptedTransport{ID: "B"}
+	tr := Transport(NewRoundRobinStrategy([]http.RoundTripper{a, b}), OptStrategyTransportWithRetry(policy))
+
+	retries := 0
+	for range 10 {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		_, err := tr.RoundTrip(req)
+		var retryErr *RetryError
+		if errors.As(err, &retryErr) {
+			retries++
+		}
+	}
+
+	// One initial token plus half a token per request, capped at one.
+	assert.Equal(t, 5, retries)
+	assert.Equal(t, 15, a.calls()+b.calls())
+}
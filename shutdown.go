@@ -0,0 +1,92 @@
+package hacktheconn
+
+import (
+	"context"
+	"net/http"
+)
+
+// begin registers a request, unless the transport is shut down.
+func (t *StrategyTransport) begin() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return false
+	}
+
+	t.inFlight.Add(1)
+	return true
+}
+
+// close stops accepting requests and, the first time, stops the background
+// goroutines of the strategy.
+func (t *StrategyTransport) close() {
+	t.mutex.Lock()
+	closed := t.closed
+	t.closed = true
+	t.mutex.Unlock()
+
+	switch {
+	case closed:
+	case t.base != nil:
+		stopStrategy(t.base)
+	default:
+		stopStrategy(t.strategy)
+	}
+}
+
+// transports lists the transports of the strategy, if it can list them.
+func (t *StrategyTransport) transports() []http.RoundTripper {
+	for _, s := range []any{t.base, t.strategy} {
+		if lister, ok := s.(TransportLister); ok {
+			return lister.Transports()
+		}
+	}
+	return nil
+}
+
+// CloseIdleConnections closes the idle connections of every transport of the
+// strategy, as http.Client.CloseIdleConnections expects. Strategies that do
+// not implement TransportLister have no transports to close.
+func (t *StrategyTransport) CloseIdleConnections() {
+	for _, transport := range t.transports() {
+		closeIdleConnections(unwrapRoundTripper(transport))
+	}
+}
+
+// Shutdown gracefully shuts the transport down: new requests fail with
+// ErrShutdown, background goroutines of the strategy, such as health checks
+// and provider watches, are stopped, and once the in-flight requests are done,
+// including reading their response bodies, the connections of every
+// transport are closed. If ctx is done first, Shutdown closes the idle
+// connections and returns the context error, leaving the in-flight requests
+// to finish, after which their connections are closed as well.
+func (t *StrategyTransport) Shutdown(ctx context.Context) error {
+	t.close()
+
+	drained := make(chan struct{})
+	go func() {
+		t.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		t.CloseIdleConnections()
+		return nil
+	case <-ctx.Done():
+		t.CloseIdleConnections()
+		go func() {
+			<-drained
+			t.CloseIdleConnections()
+		}()
+		return ctx.Err()
+	}
+}
+
+// Close shuts the transport down without waiting for in-flight requests.
+func (t *StrategyTransport) Close() error {
+	t.close()
+	t.CloseIdleConnections()
+	return nil
+}
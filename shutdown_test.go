@@ -0,0 +1,153 @@
+package hacktheconn
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newConnTrackingServer starts a server counting its open connections, whose
+// handler blocks until release is closed.
+func newConnTrackingServer(t *testing.T, release <-chan struct{}) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var open atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "ok")
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			open.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			open.Add(-1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return server, &open
+}
+
+func TestStrategyTransportShutdown(t *testing.T) {
+	release := make(chan struct{})
+	server, open := newConnTrackingServer(t, release)
+
+	direct, err := DirectTransport()
+	require.NoError(t, err)
+	transport := Transport(NewRoundRobinStrategy([]http.RoundTripper{direct}))
+	client := &http.Client{Transport: transport}
+
+	res, err := client.Get(server.URL)
+	require.NoError(t, err)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- transport.Shutdown(context.Background()) }()
+
+	assert.Eventually(t, func() bool {
+		_, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, server.URL, nil))
+		return err == ErrShutdown
+	}, time.Second, time.Millisecond)
+
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned before the in-flight request finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, "ok", string(body))
+
+	require.NoError(t, <-shutdown)
+	assert.Eventually(t, func() bool { return open.Load() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestStrategyTransportShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server, open := newConnTrackingServer(t, release)
+
+	direct, err := DirectTransport()
+	require.NoError(t, err)
+	transport := Transport(NewRoundRobinStrategy([]http.RoundTripper{direct}))
+
+	res, err := (&http.Client{Transport: transport}).Get(server.URL)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, transport.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Equal(t, int64(1), open.Load(), "the in-flight request keeps its connection")
+
+	close(release)
+	_, err = io.Copy(io.Discard, res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	assert.Eventually(t, func() bool { return open.Load() == 0 }, time.Second, time.Millisecond,
+		"the connection is closed once the request finishes")
+}
+
+func TestStrategyTransportCloseIdleConnections(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	server, open := newConnTrackingServer(t, release)
+
+	var transports []http.RoundTripper
+	for range 2 {
+		direct, err := DirectTransport()
+		require.NoError(t, err)
+		transports = append(transports, direct)
+	}
+	transport := Transport(NewOutlierDetectionStrategy(NewRoundRobinStrategy(transports)))
+	client := &http.Client{Transport: transport}
+
+	get(t, client, server.URL)
+	get(t, client, server.URL)
+	assert.Equal(t, int64(2), open.Load())
+
+	client.CloseIdleConnections()
+	assert.Eventually(t, func() bool { return open.Load() == 0 }, time.Second, time.Millisecond)
+
+	// Closing idle connections does not shut the transport down.
+	get(t, client, server.URL)
+}
+
+func TestStrategyTransportShutdownStopsStrategy(t *testing.T) {
+	var probes atomic.Int64
+	probe := func(context.Context, http.RoundTripper) error {
+		probes.Add(1)
+		return nil
+	}
+
+	pool := NewPool(NewRoundRobinStrategy(nil))
+	provider := NewEnvProxyProvider("HACKTHECONN_TEST_PROXIES")
+	t.Setenv("HACKTHECONN_TEST_PROXIES", "http://proxy-a:8080")
+	require.NoError(t, pool.Watch(context.Background(), provider, time.Millisecond, nil))
+
+	s := NewHealthCheckStrategy(pool, probe, OptHealthCheckWithInterval(time.Millisecond, 0))
+	s.Start(context.Background())
+	assert.Eventually(t, func() bool { return probes.Load() > 0 }, time.Second, time.Millisecond)
+
+	require.NoError(t, Transport(s).Shutdown(context.Background()))
+
+	stopped := probes.Load()
+	t.Setenv("HACKTHECONN_TEST_PROXIES", "http://proxy-b:8080")
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, stopped, probes.Load())
+	assert.Equal(t, []string{"http://proxy-a:8080"}, pool.Proxies())
+}
@@ -1,34 +1,404 @@
 package hacktheconn
 
 import (
+	"errors"
+	"log/slog"
 	"net/http"
+	"sync"
+	"time"
 )
 
-// strategy interface for roundtripper selection.
-type strategy interface {
+// Strategy selects a roundtripper for every request and takes it back once the
+// request is done. Strategies may additionally implement RequestAcquirer to see
+// the request being sent and ResultReleaser to learn its outcome.
+type Strategy interface {
 	Acquire() (http.RoundTripper, error)
 	Release(http.RoundTripper)
 }
 
+// Result describes how a request served by a transport ended.
+type Result struct {
+	// StatusCode is the response status code, or 0 if no response was received.
+	StatusCode int
+	// Duration spans from dispatching the request until the response body was
+	// fully read, closed or failed.
+	Duration time.Duration
+	// BytesRead is the number of response body bytes consumed by the caller.
+	BytesRead int64
+	// BytesWritten is the number of request body bytes sent by the transport.
+	BytesWritten int64
+	// Err is the error that ended the request, if any. io.EOF is not reported.
+	Err error
+}
+
+// Failed reports whether the request errored or got a server error response.
+func (r Result) Failed() bool {
+	return r.Err != nil || r.StatusCode >= http.StatusInternalServerError
+}
+
+// ResultReleaser is implemented by strategies that want to learn the outcome of
+// a request when its transport is released. StrategyTransport calls
+// ReleaseResult instead of Release when it is available.
+type ResultReleaser interface {
+	ReleaseResult(http.RoundTripper, Result)
+}
+
+// RequestAcquirer is implemented by strategies that select a transport based
+// on the request being sent. StrategyTransport calls AcquireRequest instead of
+// Acquire when it is available. The request context carries its deadline and
+// cancellation.
+type RequestAcquirer interface {
+	AcquireRequest(*http.Request) (http.RoundTripper, error)
+}
+
+// RequestStrategy is a request-aware strategy: it sees every request before
+// selecting a transport and learns the outcome of the request on release.
+// It enables host-based routing, stickiness and outcome-based scoring.
+type RequestStrategy interface {
+	RequestAcquirer
+	ResultReleaser
+}
+
+// SkipAcquirer is implemented by strategies that can pass over transports the
+// caller does not want, such as ejected or unhealthy ones. AcquireSkip returns
+// ErrNoTransports when every transport is skipped. req may be nil.
+type SkipAcquirer interface {
+	AcquireSkip(req *http.Request, skip func(http.RoundTripper) bool) (http.RoundTripper, error)
+}
+
+// TransportLister is implemented by strategies that can enumerate the
+// transports they select from, as returned by Acquire.
+type TransportLister interface {
+	Transports() []http.RoundTripper
+}
+
+// TransportSetter is implemented by strategies whose transports can be changed
+// at runtime, as done by Pool. SetTransports replaces the transports, keeping
+// the state, such as counters and latencies, of the ones that remain. It is safe
+// to call concurrently with Acquire and Release.
+type TransportSetter interface {
+	SetTransports(entries []PoolEntry)
+}
+
+// Stopper is implemented by strategies owning background goroutines, such as
+// health checkers and pools watching a provider. Stop ends them and waits for
+// them to exit. StrategyTransport.Shutdown calls it.
+type Stopper interface {
+	Stop()
+}
+
+// stopStrategy stops s if it owns background goroutines.
+func stopStrategy(s any) {
+	if stopper, ok := s.(Stopper); ok {
+		stopper.Stop()
+	}
+}
+
+// skipNone is the skip function used when no transport is excluded.
+func skipNone(http.RoundTripper) bool { return false }
+
+// defaultSkipAttempts bounds how many times a strategy that is not a
+// SkipAcquirer is asked again for a transport, when it cannot list them.
+const defaultSkipAttempts = 3
+
+// acquireSkipping acquires a transport from s that skip does not reject.
+// Strategies unaware of skipping are asked again while holding on to the
+// rejected transports, so that they move on to other ones.
+func acquireSkipping(s Strategy, req *http.Request, skip func(http.RoundTripper) bool) (http.RoundTripper, error) {
+	if skipper, ok := s.(SkipAcquirer); ok {
+		return skipper.AcquireSkip(req, skip)
+	}
+
+	attempts := defaultSkipAttempts
+	if lister, ok := s.(TransportLister); ok {
+		attempts = len(lister.Transports())
+	}
+
+	var rejected []http.RoundTripper
+	defer func() {
+		for _, transport := range rejected {
+			s.Release(transport)
+		}
+	}()
+
+	rs := AdaptStrategy(s)
+	for range attempts {
+		transport, err := rs.AcquireRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		if !skip(transport) {
+			return transport, nil
+		}
+		rejected = append(rejected, transport)
+	}
+
+	return nil, ErrNoTransports
+}
+
+// AdaptStrategy returns s as a RequestStrategy. Strategies that only implement
+// Acquire and Release are wrapped so that AcquireRequest and ReleaseResult fall
+// back to them.
+func AdaptStrategy(s Strategy) RequestStrategy {
+	if rs, ok := s.(RequestStrategy); ok {
+		return rs
+	}
+	return strategyAdapter{strategy: s}
+}
+
+// strategyAdapter fills in the request-aware methods a strategy lacks.
+type strategyAdapter struct {
+	strategy Strategy
+}
+
+func (a strategyAdapter) AcquireRequest(req *http.Request) (http.RoundTripper, error) {
+	if acquirer, ok := a.strategy.(RequestAcquirer); ok {
+		return acquirer.AcquireRequest(req)
+	}
+
+	return a.strategy.Acquire()
+}
+
+func (a strategyAdapter) ReleaseResult(transport http.RoundTripper, result Result) {
+	if releaser, ok := a.strategy.(ResultReleaser); ok {
+		releaser.ReleaseResult(transport, result)
+		return
+	}
+
+	a.strategy.Release(transport)
+}
+
 // StrategyTransport wraps a strategy for dynamic transport selection.
 type StrategyTransport struct {
-	strategy strategy
+	strategy RequestStrategy
+	// base is the strategy as a Strategy, when it is one, which lets
+	// StrategyTransport ask it for a different transport on retries.
+	base   Strategy
+	cfg    StrategyTransportConfig
+	hedger *hedger
+	logger *slog.Logger
+
+	mutex    sync.Mutex
+	closed   bool
+	inFlight sync.WaitGroup
 }
 
+type (
+	// OptStrategyTransport configures a StrategyTransport.
+	OptStrategyTransport = Option[StrategyTransportConfig]
+
+	StrategyTransportConfig struct {
+		retry   *RetryPolicy
+		hedge   *HedgePolicy
+		logger  *slog.Logger
+		metrics Metrics
+		// proxies names the transports in logs and metrics, by their
+		// innermost roundtripper, when the strategy cannot.
+		proxies map[http.RoundTripper]string
+	}
+)
+
 // Transport creates a new StrategyTransport with the given strategy.
-func Transport(strategy strategy) *StrategyTransport {
-	return &StrategyTransport{
+// Request-aware methods implemented by the strategy are detected and used.
+func Transport(strategy Strategy, opts ...OptStrategyTransport) *StrategyTransport {
+	t := TransportRequestStrategy(AdaptStrategy(strategy), opts...)
+	t.base = strategy
+	return t
+}
+
+// TransportRequestStrategy creates a new StrategyTransport with the given request-aware strategy.
+func TransportRequestStrategy(strategy RequestStrategy, opts ...OptStrategyTransport) *StrategyTransport {
+	t := &StrategyTransport{
 		strategy: strategy,
 	}
+	t.base, _ = strategy.(Strategy)
+
+	for _, opt := range opts {
+		opt(&t.cfg)
+	}
+
+	if t.cfg.hedge != nil {
+		t.hedger = newHedger(*t.cfg.hedge)
+	}
+	t.logger = loggerOrDiscard(t.cfg.logger)
+
+	return t
 }
 
 // RoundTrip selects a transport dynamically and executes the request.
+// The transport is released back to the strategy once the response body has
+// been fully read or closed, or right away if the request fails, so strategies
+// see it as busy for the whole lifetime of the response.
 func (t *StrategyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	transport, err := t.strategy.Acquire()
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	if !t.begin() {
+		return nil, ErrShutdown
+	}
+	defer t.inFlight.Done()
+
+	req = req.WithContext(withProxyCredentialsCache(req.Context()))
+
+	switch {
+	case t.hedger != nil:
+		return t.roundTripWithHedging(req, t.hedger)
+	case t.cfg.retry != nil:
+		return t.roundTripWithRetries(req, t.cfg.retry)
+	}
+
+	transport, err := t.strategy.AcquireRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.roundTrip(req, transport)
+}
+
+// roundTrip executes the request on an acquired transport and arranges its release.
+func (t *StrategyTransport) roundTrip(req *http.Request, transport http.RoundTripper) (*http.Response, error) {
+	req, written := countRequestBody(req)
+	req, recycle := withConnRecycling(req)
+	start := time.Now()
+
+	var (
+		logger = t.logger
+		debug  = logger.Enabled(req.Context(), slog.LevelDebug)
+		proxy  string
+	)
+	if debug || t.cfg.metrics != nil {
+		proxy = t.proxyName(transport)
+	}
+	if debug {
+		logger = logger.With("proxy", proxy)
+	}
+	logger.DebugContext(req.Context(), "transport selected", "method", req.Method, "host", req.URL.Host)
+	if t.cfg.metrics != nil {
+		t.cfg.metrics.TransportSelected(proxy)
+	}
+
+	t.inFlight.Add(1)
+	release := func(result Result) {
+		defer t.inFlight.Done()
+		recycle()
+		// Metrics go first: releasing the last request of a transport
+		// removed from a Pool forgets its metrics.
+		if t.cfg.metrics != nil {
+			t.cfg.metrics.RequestDone(proxy, result)
+		}
+		t.strategy.ReleaseResult(transport, result)
+	}
+
+	res, err := transport.RoundTrip(req)
 	if err != nil {
+		logger.DebugContext(req.Context(), "request failed", "duration", time.Since(start), "error", err)
+		release(Result{
+			Duration:     time.Since(start),
+			BytesWritten: written.Load(),
+			Err:          err,
+		})
 		return nil, err
 	}
-	defer t.strategy.Release(transport)
 
-	return transport.RoundTrip(req)
+	// A 407 to a request forwarded by an HTTP proxy of the transport comes
+	// from the proxy, so it fails the request like a CONNECT answered with
+	// 407 does. Otherwise, it comes from the server and is passed on.
+	if res.StatusCode == http.StatusProxyAuthRequired && req.URL.Scheme == "http" {
+		if proxyURL := requestProxy(transport, req); proxyURL != nil {
+			err := newProxyAuthError(proxyURL, res)
+			_ = res.Body.Close()
+			logger.WarnContext(req.Context(), "proxy authentication required", "error", err)
+			release(Result{
+				StatusCode:   res.StatusCode,
+				Duration:     time.Since(start),
+				BytesWritten: written.Load(),
+				Err:          err,
+			})
+			return nil, err
+		}
+	}
+
+	wrapResponseBody(res, func(bytesRead int64, err error) {
+		logger.DebugContext(req.Context(), "request done",
+			"status", res.StatusCode, "duration", time.Since(start), "bytes_read", bytesRead)
+		release(Result{
+			StatusCode:   res.StatusCode,
+			Duration:     time.Since(start),
+			BytesRead:    bytesRead,
+			BytesWritten: written.Load(),
+			Err:          err,
+		})
+	})
+
+	return res, nil
+}
+
+// proxyNamer is implemented by strategies that know the proxy of their
+// transports, as Pool does.
+type proxyNamer interface {
+	proxyName(transport http.RoundTripper) string
+}
+
+// proxyName returns the proxy of transport, with its password redacted, or an
+// empty string if unknown.
+func (t *StrategyTransport) proxyName(transport http.RoundTripper) string {
+	transport = unwrapRoundTripper(transport)
+	if proxy, ok := t.cfg.proxies[transport]; ok {
+		return proxy
+	}
+
+	for _, s := range []any{t.base, t.strategy} {
+		if namer, ok := s.(proxyNamer); ok {
+			return namer.proxyName(transport)
+		}
+	}
+	return ""
+}
+
+// acquireSkipping acquires a transport that skip does not reject, falling back
+// to any transport when the strategy cannot skip or every transport is rejected.
+func (t *StrategyTransport) acquireSkipping(
+	req *http.Request,
+	skip func(http.RoundTripper) bool,
+) (http.RoundTripper, error) {
+	var (
+		transport http.RoundTripper
+		err       error
+	)
+
+	switch {
+	case t.base != nil:
+		transport, err = acquireSkipping(t.base, req, skip)
+	case isSkipAcquirer(t.strategy):
+		transport, err = t.strategy.(SkipAcquirer).AcquireSkip(req, skip)
+	default:
+		return t.strategy.AcquireRequest(req)
+	}
+
+	if errors.Is(err, ErrNoTransports) {
+		return t.strategy.AcquireRequest(req)
+	}
+	return transport, err
+}
+
+func isSkipAcquirer(s RequestStrategy) bool {
+	_, ok := s.(SkipAcquirer)
+	return ok
+}
+
+// OptStrategyTransportWithLogger logs the transport selected for every
+// request along with its proxy, and how the request ended: debug events for
+// selections and outcomes, and a warning for proxies refusing the credentials.
+func OptStrategyTransportWithLogger(logger *slog.Logger) OptStrategyTransport {
+	return func(cfg *StrategyTransportConfig) {
+		cfg.logger = logger
+	}
+}
+
+// OptStrategyTransportWithMetrics reports every transport selection and
+// request outcome to metrics, labeled with the proxy of the transport.
+func OptStrategyTransportWithMetrics(metrics Metrics) OptStrategyTransport {
+	return func(cfg *StrategyTransportConfig) {
+		cfg.metrics = metrics
+	}
 }
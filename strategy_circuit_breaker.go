@@ -0,0 +1,440 @@
+package hacktheconn
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets requests through while watching their error ratio.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects requests until the open timeout elapses.
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of trial requests through to
+	// decide whether to close or open the circuit again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerEvent reports a state transition of the circuit breaker of a transport.
+type CircuitBreakerEvent struct {
+	Transport http.RoundTripper
+	From      CircuitState
+	To        CircuitState
+}
+
+// circuitBucket counts the outcomes of a slice of the rolling window.
+type circuitBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// circuit is the breaker of a single transport.
+type circuit struct {
+	state    CircuitState
+	buckets  []circuitBucket
+	openedAt time.Time
+
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+}
+
+// CircuitBreakerStrategy wraps a strategy with a circuit breaker per transport.
+// A closed circuit opens when the ratio of failed requests over a rolling
+// window crosses a threshold. An open circuit makes the wrapped strategy pass
+// over its transport until the open timeout elapses, and then turns half-open
+// to let a few trial requests through: if they all succeed the circuit closes,
+// and any failure opens it again.
+//
+// Failures are requests that errored or got a 5xx response, except those
+// canceled by the caller. When every circuit is open, Acquire fails fast with
+// ErrCircuitOpen.
+type CircuitBreakerStrategy struct {
+	strategy Strategy
+	adapted  RequestStrategy
+	cfg      CircuitBreakerConfig
+
+	mutex    sync.Mutex
+	circuits map[http.RoundTripper]*circuit
+}
+
+type (
+	// OptCircuitBreaker configures the circuit breakers.
+	OptCircuitBreaker = Option[CircuitBreakerConfig]
+
+	CircuitBreakerConfig struct {
+		// FailureRatio opens the circuit when this ratio of the requests in the
+		// window failed, once at least MinRequests were seen.
+		FailureRatio float64
+		MinRequests  int
+		// Window is the duration of the rolling window, split in Buckets.
+		Window  time.Duration
+		Buckets int
+		// OpenTimeout is how long a circuit stays open before turning half-open.
+		OpenTimeout time.Duration
+		// HalfOpenRequests is the number of trial requests let through, and
+		// required to succeed, while half-open.
+		HalfOpenRequests int
+		// OnStateChange is called on every state transition.
+		OnStateChange func(CircuitBreakerEvent)
+
+		clock func() time.Time
+	}
+)
+
+// NewCircuitBreakerStrategy wraps s with a circuit breaker per transport.
+func NewCircuitBreakerStrategy(s Strategy, opts ...OptCircuitBreaker) *CircuitBreakerStrategy {
+	cfg := CircuitBreakerConfig{
+		FailureRatio:     0.5,
+		MinRequests:      20,
+		Window:           10 * time.Second,
+		Buckets:          10,
+		OpenTimeout:      30 * time.Second,
+		HalfOpenRequests: 1,
+		clock:            time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if cfg.Buckets <= 0 || cfg.Window <= 0 {
+		panic("window and buckets must be greater than 0")
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		panic("half-open requests must be greater than 0")
+	}
+
+	return &CircuitBreakerStrategy{
+		strategy: s,
+		adapted:  AdaptStrategy(s),
+		cfg:      cfg,
+		circuits: make(map[http.RoundTripper]*circuit),
+	}
+}
+
+// Acquire picks a transport whose circuit lets the request through.
+func (cb *CircuitBreakerStrategy) Acquire() (http.RoundTripper, error) {
+	return cb.AcquireSkip(nil, skipNone)
+}
+
+// AcquireRequest picks a transport for req whose circuit lets the request through.
+func (cb *CircuitBreakerStrategy) AcquireRequest(req *http.Request) (http.RoundTripper, error) {
+	return cb.AcquireSkip(req, skipNone)
+}
+
+// AcquireSkip picks a transport whose circuit lets the request through and
+// that skip does not reject.
+func (cb *CircuitBreakerStrategy) AcquireSkip(
+	req *http.Request,
+	skip func(http.RoundTripper) bool,
+) (http.RoundTripper, error) {
+	// Half-open circuits may run out of trial requests between the strategy
+	// selecting their transport and the breaker admitting it. Such transports
+	// are handed back and skipped on the next attempt.
+	var (
+		rejected map[http.RoundTripper]bool
+		tripped  bool
+	)
+
+	for {
+		transport, err := acquireSkipping(cb.strategy, req, func(rt http.RoundTripper) bool {
+			if skip(rt) {
+				return true
+			}
+			if rejected[rt] || !cb.available(rt) {
+				tripped = true
+				return true
+			}
+			return false
+		})
+		if errors.Is(err, ErrNoTransports) && tripped {
+			return nil, ErrCircuitOpen
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if cb.admit(transport) {
+			return transport, nil
+		}
+
+		cb.strategy.Release(transport)
+		if rejected == nil {
+			rejected = make(map[http.RoundTripper]bool)
+		}
+		rejected[transport] = true
+	}
+}
+
+// Release hands the transport back to the wrapped strategy.
+func (cb *CircuitBreakerStrategy) Release(transport http.RoundTripper) {
+	cb.mutex.Lock()
+	if c, ok := cb.circuits[transport]; ok && c.state == CircuitHalfOpen && c.halfOpenInFlight > 0 {
+		c.halfOpenInFlight--
+	}
+	cb.mutex.Unlock()
+
+	cb.strategy.Release(transport)
+}
+
+// ReleaseResult records the outcome of the request in the circuit of the
+// transport and hands the transport back to the wrapped strategy.
+func (cb *CircuitBreakerStrategy) ReleaseResult(transport http.RoundTripper, result Result) {
+	cb.record(transport, result)
+	cb.adapted.ReleaseResult(transport, result)
+}
+
+// Transports returns the transports of the wrapped strategy, if it can list them.
+func (cb *CircuitBreakerStrategy) Transports() []http.RoundTripper {
+	if lister, ok := cb.strategy.(TransportLister); ok {
+		return lister.Transports()
+	}
+	return nil
+}
+
+// SetTransports replaces the transports of the wrapped strategy, which must
+// implement TransportSetter, and forgets the circuits of the removed ones.
+func (cb *CircuitBreakerStrategy) SetTransports(entries []PoolEntry) {
+	setTransports(cb.strategy, entries)
+	current := listedTransports(cb.strategy)
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	retainTransports(cb.circuits, current)
+}
+
+// Stop stops the wrapped strategy, if it owns background goroutines.
+func (cb *CircuitBreakerStrategy) Stop() {
+	stopStrategy(cb.strategy)
+}
+
+// State returns the current state of the circuit of transport.
+func (cb *CircuitBreakerStrategy) State(transport http.RoundTripper) CircuitState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	c, ok := cb.circuits[transport]
+	if !ok {
+		return CircuitClosed
+	}
+	return c.state
+}
+
+// available reports whether the circuit of transport may let a request
+// through. It runs while the wrapped strategy selects a transport, so it only
+// reads the circuit: open circuits whose timeout elapsed move to half-open
+// when admit lets their transport through.
+func (cb *CircuitBreakerStrategy) available(transport http.RoundTripper) bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	c, ok := cb.circuits[transport]
+	if !ok {
+		return true
+	}
+
+	switch c.state {
+	case CircuitOpen:
+		return cb.cfg.clock().Sub(c.openedAt) >= cb.cfg.OpenTimeout
+	case CircuitHalfOpen:
+		return c.halfOpenInFlight < cb.cfg.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// admit lets a selected transport through: it moves open circuits whose
+// timeout elapsed to half-open and reserves a trial request on half-open
+// circuits.
+func (cb *CircuitBreakerStrategy) admit(transport http.RoundTripper) bool {
+	var events []CircuitBreakerEvent
+	defer func() { cb.emit(events) }()
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	c, ok := cb.circuits[transport]
+	if !ok || c.state == CircuitClosed {
+		return true
+	}
+
+	if c.state == CircuitOpen {
+		if cb.cfg.clock().Sub(c.openedAt) < cb.cfg.OpenTimeout {
+			return false
+		}
+		events = append(events, cb.transition(transport, c, CircuitHalfOpen))
+	}
+
+	if c.halfOpenInFlight >= cb.cfg.HalfOpenRequests {
+		return false
+	}
+	c.halfOpenInFlight++
+	return true
+}
+
+func (cb *CircuitBreakerStrategy) record(transport http.RoundTripper, result Result) {
+	var events []CircuitBreakerEvent
+	defer func() { cb.emit(events) }()
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	c, ok := cb.circuits[transport]
+	if !ok {
+		c = &circuit{buckets: make([]circuitBucket, cb.cfg.Buckets)}
+		cb.circuits[transport] = c
+	}
+
+	// Requests canceled by the caller say nothing about the transport.
+	if errors.Is(result.Err, context.Canceled) {
+		if c.state == CircuitHalfOpen && c.halfOpenInFlight > 0 {
+			c.halfOpenInFlight--
+		}
+		return
+	}
+
+	failed := result.Failed()
+	now := cb.cfg.clock()
+
+	switch c.state {
+	case CircuitClosed:
+		bucket := c.bucket(now, cb.cfg.Window/time.Duration(cb.cfg.Buckets))
+		if failed {
+			bucket.failures++
+		} else {
+			bucket.successes++
+		}
+
+		successes, failures := c.counts(now, cb.cfg.Window)
+		total := successes + failures
+		if total >= cb.cfg.MinRequests && float64(failures)/float64(total) >= cb.cfg.FailureRatio {
+			c.openedAt = now
+			events = append(events, cb.transition(transport, c, CircuitOpen))
+		}
+	case CircuitHalfOpen:
+		if c.halfOpenInFlight > 0 {
+			c.halfOpenInFlight--
+		}
+		if failed {
+			c.openedAt = now
+			events = append(events, cb.transition(transport, c, CircuitOpen))
+			return
+		}
+		c.halfOpenSuccesses++
+		if c.halfOpenSuccesses >= cb.cfg.HalfOpenRequests {
+			clear(c.buckets)
+			events = append(events, cb.transition(transport, c, CircuitClosed))
+		}
+	}
+}
+
+// transition moves c to state and returns the event to emit once the mutex is released.
+func (cb *CircuitBreakerStrategy) transition(
+	transport http.RoundTripper,
+	c *circuit,
+	state CircuitState,
+) CircuitBreakerEvent {
+	event := CircuitBreakerEvent{Transport: transport, From: c.state, To: state}
+
+	c.state = state
+	c.halfOpenInFlight = 0
+	c.halfOpenSuccesses = 0
+
+	return event
+}
+
+func (cb *CircuitBreakerStrategy) emit(events []CircuitBreakerEvent) {
+	if cb.cfg.OnStateChange == nil {
+		return
+	}
+	for _, event := range events {
+		cb.cfg.OnStateChange(event)
+	}
+}
+
+// bucket returns the bucket for now, recycling the one it replaces in the ring.
+func (c *circuit) bucket(now time.Time, width time.Duration) *circuitBucket {
+	start := now.Truncate(width)
+	bucket := &c.buckets[int((start.UnixNano()/int64(width))%int64(len(c.buckets)))]
+	if !bucket.start.Equal(start) {
+		*bucket = circuitBucket{start: start}
+	}
+	return bucket
+}
+
+// counts sums the outcomes recorded within window before now.
+func (c *circuit) counts(now time.Time, window time.Duration) (successes, failures int) {
+	for _, bucket := range c.buckets {
+		if now.Sub(bucket.start) < window {
+			successes += bucket.successes
+			failures += bucket.failures
+		}
+	}
+	return successes, failures
+}
+
+// OptCircuitBreakerWithFailureRatio opens circuits when ratio of the requests
+// in the window failed, once at least minRequests were seen.
+func OptCircuitBreakerWithFailureRatio(ratio float64, minRequests int) OptCircuitBreaker {
+	return func(cfg *CircuitBreakerConfig) {
+		cfg.FailureRatio = ratio
+		cfg.MinRequests = minRequests
+	}
+}
+
+// OptCircuitBreakerWithWindow configures the rolling window and the number of buckets it is split in.
+func OptCircuitBreakerWithWindow(window time.Duration, buckets int) OptCircuitBreaker {
+	return func(cfg *CircuitBreakerConfig) {
+		cfg.Window = window
+		cfg.Buckets = buckets
+	}
+}
+
+// OptCircuitBreakerWithOpenTimeout configures how long circuits stay open before turning half-open.
+func OptCircuitBreakerWithOpenTimeout(timeout time.Duration) OptCircuitBreaker {
+	return func(cfg *CircuitBreakerConfig) {
+		cfg.OpenTimeout = timeout
+	}
+}
+
+// OptCircuitBreakerWithHalfOpenRequests configures the number of trial requests while half-open.
+func OptCircuitBreakerWithHalfOpenRequests(n int) OptCircuitBreaker {
+	return func(cfg *CircuitBreakerConfig) {
+		cfg.HalfOpenRequests = n
+	}
+}
+
+// OptCircuitBreakerWithEventHandler configures a callback for state transitions.
+func OptCircuitBreakerWithEventHandler(fn func(CircuitBreakerEvent)) OptCircuitBreaker {
+	return func(cfg *CircuitBreakerConfig) {
+		cfg.OnStateChange = fn
+	}
+}
+
+// OptCircuitBreakerWithClock configures a custom clock function.
+func OptCircuitBreakerWithClock(fn func() time.Time) OptCircuitBreaker {
+	return func(cfg *CircuitBreakerConfig) {
+		cfg.clock = fn
+	}
+}
@@ -0,0 +1,175 @@
+package hacktheconn
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCircuitBreakerTestStrategy(now *time.Time, events *[]CircuitBreakerEvent, s Strategy) *CircuitBreakerStrategy {
+	return NewCircuitBreakerStrategy(s,
+		OptCircuitBreakerWithClock(func() time.Time { return *now }),
+		OptCircuitBreakerWithEventHandler(func(e CircuitBreakerEvent) { *events = append(*events, e) }),
+		OptCircuitBreakerWithFailureRatio(0.5, 4),
+		OptCircuitBreakerWithWindow(10*time.Second, 10),
+		OptCircuitBreakerWithOpenTimeout(30*time.Second),
+		OptCircuitBreakerWithHalfOpenRequests(2),
+	)
+}
+
+func TestCircuitBreakerLifecycle(t *testing.T) {
+	now := time.Unix(0, 0)
+	var events []CircuitBreakerEvent
+	transports := []http.RoundTripper{&MockTransport{ID: "A"}, &MockTransport{ID: "B"}}
+	cb := newCircuitBreakerTestStrategy(&now, &events, NewRoundRobinStrategy(transports))
+
+	failure := Result{Err: errors.New("connection refused")}
+	success := Result{StatusCode: http.StatusOK}
+
+	cb.ReleaseResult(transports[0], success)
+	cb.ReleaseResult(transports[0], failure)
+	cb.ReleaseResult(transports[0], Result{StatusCode: http.StatusServiceUnavailable})
+	assert.Equal(t, CircuitClosed, cb.State(transports[0]), "below the minimum number of requests")
+	cb.ReleaseResult(transports[0], failure)
+	assert.Equal(t, CircuitOpen, cb.State(transports[0]))
+
+	assert.Equal(t, []string{"B", "B", "B"}, acquireIDs(t, cb, 3))
+
+	// Once the open timeout elapses, two trial requests are let through.
+	now = now.Add(30 * time.Second)
+	first, err := cb.Acquire()
+	require.NoError(t, err)
+	assert.Equal(t, "A", first.(*MockTransport).ID)
+	assert.Equal(t, CircuitHalfOpen, cb.State(transports[0]))
+
+	trials := 1
+	for range 4 {
+		transport, err := cb.Acquire()
+		require.NoError(t, err)
+		if transport == transports[0] {
+			trials++
+		}
+	}
+	assert.Equal(t, 2, trials)
+
+	cb.ReleaseResult(transports[0], success)
+	assert.Equal(t, CircuitHalfOpen, cb.State(transports[0]))
+	cb.ReleaseResult(transports[0], success)
+	assert.Equal(t, CircuitClosed, cb.State(transports[0]))
+
+	require.Len(t, events, 3)
+	assert.Equal(t, CircuitBreakerEvent{Transport: transports[0], From: CircuitClosed, To: CircuitOpen}, events[0])
+	assert.Equal(t, CircuitBreakerEvent{Transport: transports[0], From: CircuitOpen, To: CircuitHalfOpen}, events[1])
+	assert.Equal(t, CircuitBreakerEvent{Transport: transports[0], From: CircuitHalfOpen, To: CircuitClosed}, events[2])
+}
+
+func TestCircuitBreakerHalfOpenFailureReopens(t *testing.T) {
+	now := time.Unix(0, 0)
+	var events []CircuitBreakerEvent
+	transports := []http.RoundTripper{&MockTransport{ID: "A"}}
+	cb := newCircuitBreakerTestStrategy(&now, &events, NewFillHolesStrategy(transports))
+
+	for range 4 {
+		cb.ReleaseResult(transports[0], Result{Err: errors.New("connection refused")})
+	}
+	assert.Equal(t, CircuitOpen, cb.State(transports[0]))
+
+	_, err := cb.Acquire()
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	now = now.Add(30 * time.Second)
+	transport, err := cb.Acquire()
+	require.NoError(t, err)
+	cb.ReleaseResult(transport, Result{StatusCode: http.StatusBadGateway})
+	assert.Equal(t, CircuitOpen, cb.State(transports[0]))
+}
+
+func TestCircuitBreakerRollingWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	var events []CircuitBreakerEvent
+	transports := []http.RoundTripper{&MockTransport{ID: "A"}}
+	cb := newCircuitBreakerTestStrategy(&now, &events, NewRoundRobinStrategy(transports))
+
+	for range 3 {
+		cb.ReleaseResult(transports[0], Result{Err: errors.New("connection refused")})
+	}
+
+	// Failures older than the window are forgotten.
+	now = now.Add(11 * time.Second)
+	cb.ReleaseResult(transports[0], Result{Err: errors.New("connection refused")})
+	assert.Equal(t, CircuitClosed, cb.State(transports[0]))
+	assert.Empty(t, events)
+}
+
+func TestCircuitBreakerHalfOpensOutsideStrategyLock(t *testing.T) {
+	now := time.Unix(0, 0)
+	transports := []http.RoundTripper{&MockTransport{ID: "A"}}
+	fh := NewFillHolesStrategy(transports)
+
+	var events []CircuitBreakerEvent
+	cb := NewCircuitBreakerStrategy(fh,
+		OptCircuitBreakerWithClock(func() time.Time { return now }),
+		OptCircuitBreakerWithFailureRatio(0.5, 1),
+		OptCircuitBreakerWithOpenTimeout(30*time.Second),
+		OptCircuitBreakerWithEventHandler(func(e CircuitBreakerEvent) {
+			// Callbacks may use the wrapped strategy.
+			_ = fh.Transports()
+			events = append(events, e)
+		}),
+	)
+
+	cb.ReleaseResult(transports[0], Result{Err: errors.New("connection refused")})
+	require.Len(t, events, 1)
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, CircuitOpen, cb.State(transports[0]), "only selecting the transport half-opens its circuit")
+
+	acquired := make(chan http.RoundTripper)
+	go func() {
+		transport, err := cb.Acquire()
+		assert.NoError(t, err)
+		acquired <- transport
+	}()
+
+	select {
+	case transport := <-acquired:
+		assert.Same(t, transports[0], transport)
+	case <-time.After(time.Second):
+		t.Fatal("acquiring deadlocked on the event handler")
+	}
+	require.Len(t, events, 2)
+	assert.Equal(t, CircuitHalfOpen, events[1].To)
+}
+
+// failFastTransport fails instantly, as a proxy refusing connections does.
+type failFastTransport struct{}
+
+func (failFastTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestCircuitBreakerLeastResponseTimeAvoidsFailFast(t *testing.T) {
+	lrt := NewLeastResponseTimeStrategy(
+		[]http.RoundTripper{
+			failFastTransport{},
+			&mockLeastResponseTimeTransport{ID: 1, delay: 5 * time.Millisecond},
+		},
+		time.Now,
+		LeastResponseTimeLastResponseTimeCalculator,
+	)
+	tr := Transport(NewCircuitBreakerStrategy(lrt, OptCircuitBreakerWithFailureRatio(0.5, 3)))
+
+	failures := 0
+	for range 10 {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		if _, err := tr.RoundTrip(req); err != nil {
+			failures++
+		}
+	}
+
+	assert.Equal(t, 3, failures)
+}
@@ -1,10 +1,223 @@
 package hacktheconn
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
 
 type baseStrategyConfig struct {
 	Proxies          []string
 	TransportFactory func(string) (*http.Transport, error)
+
+	circuitBreaker   []OptCircuitBreaker
+	provider         ProxyProvider
+	providerInterval time.Duration
+	errorPolicy      ProxyErrorPolicy
+	onProxyError     func(error)
+	logger           *slog.Logger
+	metrics          Metrics
+	// proxies names the transports created by newTransport in logs and
+	// metrics.
+	proxies map[http.RoundTripper]string
+}
+
+// ProxyErrorPolicy decides whether a strategy transport is created when the
+// transports of some of its proxies cannot be.
+type ProxyErrorPolicy int
+
+const (
+	// ProxyErrorPolicyFailAny fails if the transport of any proxy fails. It is
+	// the default of the error-returning constructors, such as NewRoundRobin.
+	ProxyErrorPolicyFailAny ProxyErrorPolicy = iota
+	// ProxyErrorPolicyFailAll skips the proxies whose transport fails, and
+	// only fails if every one does.
+	ProxyErrorPolicyFailAll
+	// ProxyErrorPolicySkip skips the proxies whose transport fails, and never
+	// fails. It is the default of the constructors not returning errors, such
+	// as TransportRoundRobin.
+	ProxyErrorPolicySkip
+)
+
+// ProxyError reports a proxy whose transport cannot be created, or whose
+// provider failed to load.
+type ProxyError struct {
+	// Proxy is the proxy URL, with its password redacted.
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s: %v", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// redactProxy returns proxy with its password, if any, redacted.
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil || u.User == nil {
+		return proxy
+	}
+	return u.Redacted()
+}
+
+// buildTransports calls build with every configured proxy, and returns the
+// failures joined, as allowed by the error policy. The error callback, if
+// any, is called with every failure.
+func (c *baseStrategyConfig) buildTransports(build func(proxy string) error) error {
+	var errs []error
+	for _, proxy := range c.Proxies {
+		if err := build(proxy); err != nil {
+			err = &ProxyError{Proxy: redactProxy(proxy), Err: err}
+			c.reportProxyError(err)
+			errs = append(errs, err)
+		}
+	}
+
+	return c.policyError(errs, len(errs) == len(c.Proxies))
+}
+
+// reportProxyError logs err and passes it to the error callback, if any.
+func (c *baseStrategyConfig) reportProxyError(err error) {
+	loggerOrDiscard(c.logger).Warn("proxy transport failed", "error", err)
+	if c.onProxyError != nil {
+		c.onProxyError(err)
+	}
+}
+
+// transportFactory returns the transport factory, logging the dials of the
+// transports it creates if a logger is configured.
+func (c *baseStrategyConfig) transportFactory() func(string) (*http.Transport, error) {
+	if c.logger == nil {
+		return c.TransportFactory
+	}
+
+	return func(proxy string) (*http.Transport, error) {
+		t, err := c.TransportFactory(proxy)
+		if err != nil {
+			return nil, err
+		}
+		logTransportDials(t, c.logger.With("proxy", redactProxy(proxy)))
+		return t, nil
+	}
+}
+
+// newTransport creates the transport of proxy, remembering its proxy for the
+// logs and metrics of the StrategyTransport.
+func (c *baseStrategyConfig) newTransport(proxy string) (*http.Transport, error) {
+	t, err := c.transportFactory()(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.logger != nil || c.metrics != nil {
+		if c.proxies == nil {
+			c.proxies = make(map[http.RoundTripper]string)
+		}
+		c.proxies[t] = redactProxy(proxy)
+	}
+	return t, nil
+}
+
+// transportOptions returns the options of the StrategyTransport.
+func (c *baseStrategyConfig) transportOptions() []OptStrategyTransport {
+	if c.logger == nil && c.metrics == nil {
+		return nil
+	}
+
+	return []OptStrategyTransport{func(cfg *StrategyTransportConfig) {
+		cfg.logger = c.logger
+		cfg.metrics = c.metrics
+		cfg.proxies = c.proxies
+	}}
+}
+
+// policyError returns errs joined, unless the error policy allows them. all
+// tells whether every proxy failed.
+func (c *baseStrategyConfig) policyError(errs []error, all bool) error {
+	switch {
+	case len(errs) == 0:
+		return nil
+	case c.errorPolicy == ProxyErrorPolicyFailAny,
+		c.errorPolicy == ProxyErrorPolicyFailAll && all:
+		return errors.Join(errs...)
+	default:
+		return nil
+	}
+}
+
+// wrapStrategy applies the wrappers configured through options to s.
+func (c *baseStrategyConfig) wrapStrategy(s Strategy) Strategy {
+	if c.circuitBreaker != nil {
+		s = NewCircuitBreakerStrategy(s, c.circuitBreaker...)
+	}
+	return s
+}
+
+// splitErrors returns the errors joined in err, such as the *ProxyError of
+// every proxy Pool.Replace skipped, or err alone.
+func splitErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// providerTransport creates a StrategyTransport over a Pool of s, starting
+// with the configured proxies and fed by the proxy provider from then on.
+// Proxies that fail are skipped, and the failures are handled like the ones
+// of buildTransports, one per proxy. The failures of later loads are passed to
+// the error callback, if any.
+func (c *baseStrategyConfig) providerTransport(s Strategy) (*StrategyTransport, error) {
+	if c.providerInterval <= 0 {
+		return nil, fmt.Errorf("watching proxy provider: %w", ErrBadInterval)
+	}
+
+	pool := NewPool(c.wrapStrategy(s),
+		OptPoolWithTransportFactory(c.transportFactory()),
+		OptPoolWithLogger(c.logger),
+		OptPoolWithMetrics(c.metrics),
+	)
+
+	var errs []error
+	report := func(err error) {
+		for _, err := range splitErrors(err) {
+			c.reportProxyError(err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(c.Proxies) > 0 {
+		if err := pool.Replace(c.Proxies); err != nil {
+			report(err)
+		}
+	}
+
+	var onError func(error)
+	if c.onProxyError != nil {
+		onError = func(err error) {
+			for _, err := range splitErrors(err) {
+				c.onProxyError(err)
+			}
+		}
+	}
+	if err := pool.Watch(context.Background(), c.provider, c.providerInterval, onError); err != nil {
+		report(err)
+	}
+
+	if err := c.policyError(errs, len(pool.Proxies()) == 0); err != nil {
+		pool.Stop()
+		return nil, err
+	}
+
+	return Transport(pool, c.transportOptions()...), nil
 }
 
 type Option[T any] func(*T)
@@ -0,0 +1,312 @@
+package hacktheconn
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// DefaultConsistentHashReplicas is the default number of virtual nodes per transport.
+const DefaultConsistentHashReplicas = 160
+
+// ConsistentHashKeyFunc extracts the routing key from a request.
+type ConsistentHashKeyFunc func(*http.Request) string
+
+// ConsistentHashByHeader routes requests by the value of the given header.
+func ConsistentHashByHeader(name string) ConsistentHashKeyFunc {
+	return func(req *http.Request) string {
+		return req.Header.Get(name)
+	}
+}
+
+// ConsistentHashByCookie routes requests by the value of the given cookie.
+func ConsistentHashByCookie(name string) ConsistentHashKeyFunc {
+	return func(req *http.Request) string {
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+}
+
+// ConsistentHashByHost routes requests by the host of their URL.
+func ConsistentHashByHost(req *http.Request) string {
+	return req.URL.Host
+}
+
+// ringNode is a virtual node in the hash ring.
+type ringNode struct {
+	hash  uint64
+	index int
+}
+
+// ConsistentHashStrategy routes requests with the same key through the same
+// transport, using a hash ring with virtual nodes. Transports are placed on the
+// ring by name, so adding or removing one only remaps about 1/N of the keys.
+// Requests with an empty key are spread round-robin.
+type ConsistentHashStrategy struct {
+	ring     atomic.Pointer[hashRing]
+	replicas int
+	keyFunc  ConsistentHashKeyFunc
+	counter  atomic.Uint64
+}
+
+// hashRing is an immutable ring, swapped as a whole by SetTransports so that
+// Acquire does not need a lock.
+type hashRing struct {
+	transports []http.RoundTripper
+	nodes      []ringNode
+}
+
+func newHashRing(transports []http.RoundTripper, names []string, replicas int) *hashRing {
+	ring := &hashRing{
+		transports: transports,
+		nodes:      make([]ringNode, 0, len(transports)*replicas),
+	}
+
+	for i, name := range names {
+		for r := range replicas {
+			ring.nodes = append(ring.nodes, ringNode{
+				hash:  hashKey(name + "#" + strconv.Itoa(r)),
+				index: i,
+			})
+		}
+	}
+
+	sort.Slice(ring.nodes, func(i, j int) bool {
+		return ring.nodes[i].hash < ring.nodes[j].hash
+	})
+
+	return ring
+}
+
+// NewConsistentHashStrategy initializes the consistent hash strategy. names[i]
+// identifies transports[i] on the ring and must be stable across restarts for
+// keys to keep their mapping, proxy URLs being a natural choice. replicas is the
+// number of virtual nodes per transport.
+func NewConsistentHashStrategy(
+	transports []http.RoundTripper,
+	names []string,
+	keyFunc ConsistentHashKeyFunc,
+	replicas int,
+) *ConsistentHashStrategy {
+	if len(names) != len(transports) {
+		panic("names and transports must have the same length")
+	}
+	if replicas <= 0 {
+		panic("replicas must be greater than 0")
+	}
+
+	ch := &ConsistentHashStrategy{
+		replicas: replicas,
+		keyFunc:  keyFunc,
+	}
+	ch.ring.Store(newHashRing(transports, names, replicas))
+
+	return ch
+}
+
+// Acquire picks the next transport in a round-robin manner, as there is no
+// request to extract a key from.
+func (ch *ConsistentHashStrategy) Acquire() (http.RoundTripper, error) {
+	return ch.AcquireSkip(nil, skipNone)
+}
+
+// AcquireRequest picks the transport owning the request key on the ring.
+func (ch *ConsistentHashStrategy) AcquireRequest(req *http.Request) (http.RoundTripper, error) {
+	return ch.AcquireSkip(req, skipNone)
+}
+
+// AcquireSkip picks the transport owning the request key on the ring. When skip
+// rejects it, the ring is walked clockwise to the next transport, so keys of a
+// skipped transport are spread over the rest while all other keys stay put.
+func (ch *ConsistentHashStrategy) AcquireSkip(
+	req *http.Request,
+	skip func(http.RoundTripper) bool,
+) (http.RoundTripper, error) {
+	var key string
+	if req != nil {
+		key = ch.keyFunc(req)
+	}
+
+	ring := ch.ring.Load()
+	if key == "" {
+		return ch.next(ring, skip)
+	}
+
+	return ring.lookup(key, skip)
+}
+
+func (ch *ConsistentHashStrategy) next(ring *hashRing, skip func(http.RoundTripper) bool) (http.RoundTripper, error) {
+	for range ring.transports {
+		next := ch.counter.Add(1) - 1
+		if transport := ring.transports[next%uint64(len(ring.transports))]; !skip(transport) {
+			return transport, nil
+		}
+	}
+
+	return nil, ErrNoTransports
+}
+
+func (r *hashRing) lookup(key string, skip func(http.RoundTripper) bool) (http.RoundTripper, error) {
+	hash := hashKey(key)
+	start := sort.Search(len(r.nodes), func(i int) bool {
+		return r.nodes[i].hash >= hash
+	})
+
+	for i := range r.nodes {
+		node := r.nodes[(start+i)%len(r.nodes)]
+		if transport := r.transports[node.index]; !skip(transport) {
+			return transport, nil
+		}
+	}
+
+	return nil, ErrNoTransports
+}
+
+func (ch *ConsistentHashStrategy) Release(http.RoundTripper) {}
+
+// Transports returns the transports the strategy selects from.
+func (ch *ConsistentHashStrategy) Transports() []http.RoundTripper {
+	return ch.ring.Load().transports
+}
+
+// SetTransports rebuilds the ring from the entries, naming transports by their
+// proxy URL. Keys owned by the transports that remain keep their mapping.
+func (ch *ConsistentHashStrategy) SetTransports(entries []PoolEntry) {
+	transports := make([]http.RoundTripper, len(entries))
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		transports[i] = entry.Transport
+		names[i] = entry.Proxy
+	}
+
+	ch.ring.Store(newHashRing(transports, names, ch.replicas))
+}
+
+// hashKey hashes s with FNV-1a followed by a 64-bit finalizer, which spreads
+// similar keys such as "proxy#1" and "proxy#2" evenly over the ring.
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
+
+type (
+	// OptConsistentHash configures the consistent hash strategy.
+	OptConsistentHash = Option[ConsistentHashConfig]
+
+	ConsistentHashConfig struct {
+		baseStrategyConfig
+
+		replicas int
+	}
+)
+
+// TransportConsistentHash creates a consistent hash StrategyTransport that routes
+// requests by the key returned by keyFunc. Proxy URLs name the transports on the ring.
+// Proxies whose transport cannot be created are skipped; see NewConsistentHash.
+func TransportConsistentHash(
+	proxies []string,
+	keyFunc ConsistentHashKeyFunc,
+	opts ...OptConsistentHash,
+) http.RoundTripper {
+	t, _ := NewConsistentHash(proxies, keyFunc, append(opts[:len(opts):len(opts)], func(cfg *ConsistentHashConfig) {
+		cfg.errorPolicy = ProxyErrorPolicySkip
+	})...)
+	return t
+}
+
+// NewConsistentHash creates a consistent hash StrategyTransport like
+// TransportConsistentHash. It fails with the errors of every proxy whose
+// transport cannot be created, unless another policy is set with
+// OptConsistentHashWithProxyErrorPolicy.
+func NewConsistentHash(
+	proxies []string,
+	keyFunc ConsistentHashKeyFunc,
+	opts ...OptConsistentHash,
+) (*StrategyTransport, error) {
+	cfg := &ConsistentHashConfig{
+		baseStrategyConfig: baseStrategyConfig{
+			Proxies:          proxies,
+			TransportFactory: DefaultTransportFactory,
+		},
+		replicas: DefaultConsistentHashReplicas,
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	var (
+		transports []http.RoundTripper
+		names      []string
+	)
+	err := cfg.buildTransports(func(proxy string) error {
+		transport, err := cfg.newTransport(proxy)
+		if err != nil {
+			return err
+		}
+		transports = append(transports, transport)
+		names = append(names, proxy)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return Transport(NewConsistentHashStrategy(transports, names, keyFunc, cfg.replicas), cfg.transportOptions()...), nil
+}
+
+func OptConsistentHashWithTransportFactory(factory func(string) (*http.Transport, error)) OptConsistentHash {
+	return func(cfg *ConsistentHashConfig) {
+		cfg.TransportFactory = factory
+	}
+}
+
+// OptConsistentHashWithProxyErrorPolicy configures whether NewConsistentHash
+// fails when the transports of some proxies cannot be created, and a
+// callback, if not nil, called with every such failure.
+func OptConsistentHashWithProxyErrorPolicy(policy ProxyErrorPolicy, onError func(error)) OptConsistentHash {
+	return func(cfg *ConsistentHashConfig) {
+		cfg.errorPolicy = policy
+		cfg.onProxyError = onError
+	}
+}
+
+// OptConsistentHashWithLogger logs, through logger, the transport selected for every
+// request, the connections dialed by the transports, the proxies whose
+// transport fails and, with a proxy provider, the proxies added and removed.
+func OptConsistentHashWithLogger(logger *slog.Logger) OptConsistentHash {
+	return func(cfg *ConsistentHashConfig) {
+		cfg.logger = logger
+	}
+}
+
+// OptConsistentHashWithMetrics reports every transport selection and request
+// outcome to metrics, labeled with the proxy of the transport.
+func OptConsistentHashWithMetrics(metrics Metrics) OptConsistentHash {
+	return func(cfg *ConsistentHashConfig) {
+		cfg.metrics = metrics
+	}
+}
+
+// OptConsistentHashWithReplicas configures the number of virtual nodes per transport.
+// More replicas spread keys more evenly at the cost of memory.
+func OptConsistentHashWithReplicas(replicas int) OptConsistentHash {
+	return func(cfg *ConsistentHashConfig) {
+		cfg.replicas = replicas
+	}
+}
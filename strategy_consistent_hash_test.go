@@ -0,0 +1,95 @@
+package hacktheconn
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newConsistentHashTestStrategy(ids ...string) *ConsistentHashStrategy {
+	transports := make([]http.RoundTripper, len(ids))
+	for i, id := range ids {
+		transports[i] = &MockTransport{ID: id}
+	}
+	return NewConsistentHashStrategy(
+		transports,
+		ids,
+		ConsistentHashByHeader("X-Account"),
+		DefaultConsistentHashReplicas,
+	)
+}
+
+func acquireForAccount(t *testing.T, s *ConsistentHashStrategy, account string) string {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	req.Header.Set("X-Account", account)
+
+	transport, err := s.AcquireRequest(req)
+	require.NoError(t, err)
+	return transport.(*MockTransport).ID
+}
+
+func TestConsistentHashStrategySticky(t *testing.T) {
+	s := newConsistentHashTestStrategy("A", "B", "C")
+
+	for i := range 100 {
+		account := fmt.Sprintf("account-%d", i)
+		first := acquireForAccount(t, s, account)
+		for range 3 {
+			assert.Equal(t, first, acquireForAccount(t, s, account))
+		}
+	}
+}
+
+func TestConsistentHashStrategyRemapsFewKeys(t *testing.T) {
+	before := newConsistentHashTestStrategy("A", "B", "C", "D", "E")
+	after := newConsistentHashTestStrategy("A", "B", "C", "D")
+
+	const keys = 10000
+	remapped := 0
+	counts := make(map[string]int)
+	for i := range keys {
+		account := fmt.Sprintf("account-%d", i)
+		from := acquireForAccount(t, before, account)
+		to := acquireForAccount(t, after, account)
+		counts[from]++
+		if from != to {
+			remapped++
+			// Only keys owned by the removed transport may move.
+			assert.Equal(t, "E", from)
+		}
+	}
+
+	assert.InDelta(t, keys/5, remapped, keys/20)
+	for id, count := range counts {
+		assert.InDelta(t, keys/5, count, keys/10, "transport %s", id)
+	}
+}
+
+func TestConsistentHashStrategyEmptyKey(t *testing.T) {
+	s := newConsistentHashTestStrategy("A", "B", "C")
+
+	var ids []string
+	for range 3 {
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+		transport, err := s.AcquireRequest(req)
+		require.NoError(t, err)
+		ids = append(ids, transport.(*MockTransport).ID)
+	}
+
+	assert.Equal(t, []string{"A", "B", "C"}, ids)
+}
+
+func TestConsistentHashStrategyNoTransports(t *testing.T) {
+	s := newConsistentHashTestStrategy()
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	req.Header.Set("X-Account", "account")
+
+	_, err := s.AcquireRequest(req)
+	assert.ErrorIs(t, err, ErrNoTransports)
+}
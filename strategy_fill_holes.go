@@ -1,9 +1,10 @@
 package hacktheconn
 
 import (
-	"fmt"
+	"log/slog"
 	"net/http"
 	"sync"
+	"time"
 )
 
 // FillHolesStrategy selects the transport with the least ongoing requests.
@@ -23,23 +24,28 @@ func NewFillHolesStrategy(transports []http.RoundTripper) *FillHolesStrategy {
 
 // Acquire picks the transport with the least ongoing requests.
 func (fh *FillHolesStrategy) Acquire() (http.RoundTripper, error) {
-	if len(fh.transports) == 0 {
-		return nil, ErrNoTransports
-	}
+	return fh.AcquireSkip(nil, skipNone)
+}
 
+// AcquireSkip picks the transport with the least ongoing requests that skip does not reject.
+func (fh *FillHolesStrategy) AcquireSkip(_ *http.Request, skip func(http.RoundTripper) bool) (http.RoundTripper, error) {
 	fh.mutex.Lock()
 	defer fh.mutex.Unlock()
 
-	minIndex := 0
-	minCount := fh.requestCounts[0]
-
+	minIndex := -1
 	for i, count := range fh.requestCounts {
-		if count < minCount {
+		if skip(fh.transports[i]) {
+			continue
+		}
+		if minIndex < 0 || count < fh.requestCounts[minIndex] {
 			minIndex = i
-			minCount = count
 		}
 	}
 
+	if minIndex < 0 {
+		return nil, ErrNoTransports
+	}
+
 	fh.requestCounts[minIndex]++
 	return fh.transports[minIndex], nil
 }
@@ -60,37 +66,86 @@ func (fh *FillHolesStrategy) Release(transport http.RoundTripper) {
 	}
 }
 
+// Transports returns the transports the strategy selects from.
+func (fh *FillHolesStrategy) Transports() []http.RoundTripper {
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+
+	return fh.transports
+}
+
+// SetTransports replaces the transports, keeping the request counts of the ones that remain.
+func (fh *FillHolesStrategy) SetTransports(entries []PoolEntry) {
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+
+	counts := make(map[http.RoundTripper]int, len(fh.transports))
+	for i, transport := range fh.transports {
+		counts[transport] = fh.requestCounts[i]
+	}
+
+	fh.transports = make([]http.RoundTripper, len(entries))
+	fh.requestCounts = make([]int, len(entries))
+	for i, entry := range entries {
+		fh.transports[i] = entry.Transport
+		fh.requestCounts[i] = counts[entry.Transport]
+	}
+}
+
 type (
 	OptFillHoles func(*FillHolesConfig)
 
 	FillHolesConfig struct {
-		Proxies          []string
-		TransportFactory func(string) (*http.Transport, error)
+		baseStrategyConfig
 	}
 )
 
 // TransportFillHoles creates a round-robin StrategyTransport with configurable options.
+// Proxies whose transport cannot be created are skipped; see NewFillHoles. It
+// panics if the options are invalid, e.g. with a non-positive provider interval.
 func TransportFillHoles(proxies []string, opts ...OptFillHoles) http.RoundTripper {
+	t, err := NewFillHoles(proxies, append(opts[:len(opts):len(opts)], func(cfg *FillHolesConfig) {
+		cfg.errorPolicy = ProxyErrorPolicySkip
+	})...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// NewFillHoles creates a fill holes StrategyTransport with configurable options.
+// It fails with the errors of every proxy whose transport cannot be created,
+// unless another policy is set with OptFillHolesWithProxyErrorPolicy.
+func NewFillHoles(proxies []string, opts ...OptFillHoles) (*StrategyTransport, error) {
 	cfg := &FillHolesConfig{
-		Proxies:          proxies,
-		TransportFactory: DefaultTransportFactory,
+		baseStrategyConfig: baseStrategyConfig{
+			Proxies:          proxies,
+			TransportFactory: DefaultTransportFactory,
+		},
 	}
 
 	for _, opt := range opts {
 		opt(cfg)
 	}
 
+	if cfg.provider != nil {
+		return cfg.providerTransport(NewFillHolesStrategy(nil))
+	}
+
 	var transports []http.RoundTripper
-	for _, proxy := range cfg.Proxies {
-		transport, err := cfg.TransportFactory(proxy)
+	err := cfg.buildTransports(func(proxy string) error {
+		transport, err := cfg.newTransport(proxy)
 		if err != nil {
-			fmt.Printf("Error creating transport for proxy %s: %v\n", proxy, err)
-			continue
+			return err
 		}
 		transports = append(transports, transport)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return Transport(NewFillHolesStrategy(transports))
+	return Transport(cfg.wrapStrategy(NewFillHolesStrategy(transports)), cfg.transportOptions()...), nil
 }
 
 // TransportDirectFillHoles creates multiple direct connections using fill holes strategy.
@@ -105,3 +160,47 @@ func OptFillHolesWithTransportFactory(factory func(string) (*http.Transport, err
 		cfg.TransportFactory = factory
 	}
 }
+
+// OptFillHolesWithCircuitBreaker guards every transport with a circuit breaker.
+func OptFillHolesWithCircuitBreaker(opts ...OptCircuitBreaker) OptFillHoles {
+	return func(cfg *FillHolesConfig) {
+		cfg.circuitBreaker = append([]OptCircuitBreaker{}, opts...)
+	}
+}
+
+// OptFillHolesWithProxyErrorPolicy configures whether NewFillHoles fails when
+// the transports of some proxies cannot be created, and a callback, if not
+// nil, called with every such failure, and with the failures of the proxy
+// provider, if any.
+func OptFillHolesWithProxyErrorPolicy(policy ProxyErrorPolicy, onError func(error)) OptFillHoles {
+	return func(cfg *FillHolesConfig) {
+		cfg.errorPolicy = policy
+		cfg.onProxyError = onError
+	}
+}
+
+// OptFillHolesWithLogger logs, through logger, the transport selected for every
+// request, the connections dialed by the transports, the proxies whose
+// transport fails and, with a proxy provider, the proxies added and removed.
+func OptFillHolesWithLogger(logger *slog.Logger) OptFillHoles {
+	return func(cfg *FillHolesConfig) {
+		cfg.logger = logger
+	}
+}
+
+// OptFillHolesWithMetrics reports every transport selection and request
+// outcome to metrics, labeled with the proxy of the transport.
+func OptFillHolesWithMetrics(metrics Metrics) OptFillHoles {
+	return func(cfg *FillHolesConfig) {
+		cfg.metrics = metrics
+	}
+}
+
+// OptFillHolesWithProxyProvider feeds the proxies from provider, polled at every
+// interval, replacing the ones given to TransportFillHoles once it loads.
+func OptFillHolesWithProxyProvider(provider ProxyProvider, interval time.Duration) OptFillHoles {
+	return func(cfg *FillHolesConfig) {
+		cfg.provider = provider
+		cfg.providerInterval = interval
+	}
+}
@@ -0,0 +1,500 @@
+package hacktheconn
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HealthProbe checks whether a transport is able to serve requests.
+type HealthProbe func(ctx context.Context, transport http.RoundTripper) error
+
+// HTTPHealthProbe sends a GET request to checkURL through the transport. Any
+// response below 400 counts as healthy.
+func HTTPHealthProbe(checkURL string) HealthProbe {
+	return func(ctx context.Context, transport http.RoundTripper) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+		if err != nil {
+			return err
+		}
+
+		res, err := unwrapRoundTripper(transport).RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		_, _ = io.Copy(io.Discard, res.Body)
+
+		if res.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("health check %s: unexpected status %s", checkURL, res.Status)
+		}
+		return nil
+	}
+}
+
+// ConnectHealthProbe opens a TCP connection to address ("host:port") through
+// the transport and closes it right away. HTTP proxies are asked to CONNECT to
+// address, SOCKS5 proxies to dial it, and direct transports dial it themselves.
+func ConnectHealthProbe(address string) HealthProbe {
+	return func(ctx context.Context, transport http.RoundTripper) error {
+		t, ok := unwrapRoundTripper(transport).(*http.Transport)
+		if !ok {
+			return fmt.Errorf("connect health check: unsupported transport %T", transport)
+		}
+
+		conn, err := dialThroughTransport(ctx, t, address)
+		if err != nil {
+			return fmt.Errorf("connect health check %s: %w", address, err)
+		}
+		return conn.Close()
+	}
+}
+
+// dialThroughTransport opens a TCP connection to address the way t would,
+// with its TLS configuration for HTTPS proxies and its CONNECT headers.
+func dialThroughTransport(ctx context.Context, t *http.Transport, address string) (net.Conn, error) {
+	var proxyURL *url.URL
+	if t.Proxy != nil {
+		var err error
+		proxyURL, err = t.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: address}})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	if proxyURL == nil {
+		return dial(ctx, "tcp", address)
+	}
+
+	conn, err := dialProxy(ctx, t, dial, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := proxyConnect(ctx, conn, t, proxyURL, address); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// dialProxy connects to the HTTP proxy at proxyURL the way t would: HTTPS
+// proxies through the TLS dialer of t if any, or else with its TLS
+// configuration.
+func dialProxy(
+	ctx context.Context,
+	t *http.Transport,
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+	proxyURL *url.URL,
+) (net.Conn, error) {
+	if proxyURL.Scheme != "https" {
+		return dial(ctx, "tcp", proxyURL.Host)
+	}
+	if t.DialTLSContext != nil {
+		return t.DialTLSContext(ctx, "tcp", proxyURL.Host)
+	}
+
+	conn, err := dial(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		tlsConfig = t.TLSClientConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = proxyURL.Hostname()
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// proxyConnect asks the HTTP proxy on the other end of conn to tunnel to
+// address, with the CONNECT headers of t, and checks the response as t does.
+func proxyConnect(ctx context.Context, conn net.Conn, t *http.Transport, proxyURL *url.URL, address string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	header := t.ProxyConnectHeader.Clone()
+	if t.GetProxyConnectHeader != nil {
+		var err error
+		if header, err = t.GetProxyConnectHeader(ctx, proxyURL, address); err != nil {
+			return err
+		}
+		header = header.Clone()
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: header,
+	}
+	if user := proxyURL.User; user != nil && header.Get("Proxy-Authorization") == "" {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+
+	if t.OnProxyConnectResponse != nil {
+		if err := t.OnProxyConnectResponse(ctx, proxyURL, req, res); err != nil {
+			return err
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy CONNECT: unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// unwrapRoundTripper returns the innermost roundtripper of wrappers exposing
+// Unwrap, such as the ones used by LeastResponseTimeStrategy.
+func unwrapRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	for {
+		wrapper, ok := rt.(interface{ Unwrap() http.RoundTripper })
+		if !ok {
+			return rt
+		}
+		rt = wrapper.Unwrap()
+	}
+}
+
+// HealthEvent reports a transport changing health.
+type HealthEvent struct {
+	Transport http.RoundTripper
+	Healthy   bool
+	// Err is the error of the probe that made the transport unhealthy.
+	Err error
+}
+
+// healthState tracks the probe outcomes of a single transport.
+type healthState struct {
+	unhealthy            bool
+	consecutiveSuccesses int
+	consecutiveFailures  int
+}
+
+// HealthCheckStrategy wraps a strategy with active health checking: once
+// started, it probes every transport of the wrapped strategy at a set interval
+// and makes the strategy pass over the unhealthy ones. Transports start
+// healthy. The wrapped strategy must implement TransportLister, as all
+// built-in strategies do.
+//
+// When every transport is unhealthy or skipped, the wrapped strategy is used as
+// is, so that requests are still attempted.
+type HealthCheckStrategy struct {
+	strategy Strategy
+	adapted  RequestStrategy
+	lister   TransportLister
+	probe    HealthProbe
+	cfg      HealthCheckConfig
+
+	mutex  sync.Mutex
+	states map[http.RoundTripper]*healthState
+
+	lifecycle sync.Mutex
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+type (
+	// OptHealthCheck configures the health checker.
+	OptHealthCheck = Option[HealthCheckConfig]
+
+	HealthCheckConfig struct {
+		// Interval is the time between two rounds of probes.
+		Interval time.Duration
+		// Jitter adds a random delay up to this duration to every interval.
+		Jitter time.Duration
+		// Timeout bounds every single probe.
+		Timeout time.Duration
+		// HealthyThreshold is the number of consecutive successful probes that
+		// make an unhealthy transport healthy again.
+		HealthyThreshold int
+		// UnhealthyThreshold is the number of consecutive failed probes that
+		// make a healthy transport unhealthy.
+		UnhealthyThreshold int
+		// OnEvent is called whenever a transport changes health.
+		OnEvent func(HealthEvent)
+	}
+)
+
+// NewHealthCheckStrategy wraps s with active health checking using probe.
+// Call Start to begin probing.
+func NewHealthCheckStrategy(s Strategy, probe HealthProbe, opts ...OptHealthCheck) *HealthCheckStrategy {
+	lister, ok := s.(TransportLister)
+	if !ok {
+		panic("health checked strategy must implement TransportLister")
+	}
+
+	cfg := HealthCheckConfig{
+		Interval:           10 * time.Second,
+		Jitter:             time.Second,
+		Timeout:            5 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if cfg.Interval <= 0 {
+		panic("interval must be greater than 0")
+	}
+
+	return &HealthCheckStrategy{
+		strategy: s,
+		adapted:  AdaptStrategy(s),
+		lister:   lister,
+		probe:    probe,
+		cfg:      cfg,
+		states:   make(map[http.RoundTripper]*healthState),
+	}
+}
+
+// Start probes all transports right away and then at every interval, until
+// ctx is done or Stop is called. Calling Start on a running checker is a no-op.
+func (hc *HealthCheckStrategy) Start(ctx context.Context) {
+	hc.lifecycle.Lock()
+	defer hc.lifecycle.Unlock()
+
+	if hc.cancel != nil {
+		return
+	}
+
+	ctx, hc.cancel = context.WithCancel(ctx)
+	hc.done = make(chan struct{})
+
+	go hc.run(ctx, hc.done)
+}
+
+// Stop stops probing and waits for the running round of probes to finish. It
+// also stops the wrapped strategy, if it owns background goroutines.
+func (hc *HealthCheckStrategy) Stop() {
+	hc.stop()
+	stopStrategy(hc.strategy)
+}
+
+func (hc *HealthCheckStrategy) stop() {
+	hc.lifecycle.Lock()
+	defer hc.lifecycle.Unlock()
+
+	if hc.cancel == nil {
+		return
+	}
+
+	hc.cancel()
+	<-hc.done
+	hc.cancel = nil
+}
+
+func (hc *HealthCheckStrategy) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	for {
+		hc.Check(ctx)
+
+		delay := hc.cfg.Interval
+		if hc.cfg.Jitter > 0 {
+			delay += rand.N(hc.cfg.Jitter)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Check runs one round of probes against all transports concurrently and
+// waits for them to finish.
+func (hc *HealthCheckStrategy) Check(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, transport := range hc.lister.Transports() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			probeCtx, cancel := context.WithTimeout(ctx, hc.cfg.Timeout)
+			defer cancel()
+
+			err := hc.probe(probeCtx, transport)
+			if ctx.Err() != nil {
+				// Probes aborted by Stop say nothing about the transport.
+				return
+			}
+			hc.record(transport, err)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (hc *HealthCheckStrategy) record(transport http.RoundTripper, err error) {
+	hc.mutex.Lock()
+
+	state, ok := hc.states[transport]
+	if !ok {
+		state = &healthState{}
+		hc.states[transport] = state
+	}
+
+	changed := false
+	if err != nil {
+		state.consecutiveSuccesses = 0
+		state.consecutiveFailures++
+		if !state.unhealthy && state.consecutiveFailures >= hc.cfg.UnhealthyThreshold {
+			state.unhealthy = true
+			changed = true
+		}
+	} else {
+		state.consecutiveFailures = 0
+		state.consecutiveSuccesses++
+		if state.unhealthy && state.consecutiveSuccesses >= hc.cfg.HealthyThreshold {
+			state.unhealthy = false
+			changed = true
+		}
+	}
+	healthy := !state.unhealthy
+
+	hc.mutex.Unlock()
+
+	if changed && hc.cfg.OnEvent != nil {
+		hc.cfg.OnEvent(HealthEvent{Transport: transport, Healthy: healthy, Err: err})
+	}
+}
+
+// Healthy reports whether transport is currently considered healthy.
+func (hc *HealthCheckStrategy) Healthy(transport http.RoundTripper) bool {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	state, ok := hc.states[transport]
+	return !ok || !state.unhealthy
+}
+
+// Acquire picks a healthy transport from the wrapped strategy.
+func (hc *HealthCheckStrategy) Acquire() (http.RoundTripper, error) {
+	return hc.AcquireSkip(nil, skipNone)
+}
+
+// AcquireRequest picks a healthy transport for req from the wrapped strategy.
+func (hc *HealthCheckStrategy) AcquireRequest(req *http.Request) (http.RoundTripper, error) {
+	return hc.AcquireSkip(req, skipNone)
+}
+
+// AcquireSkip picks a healthy transport from the wrapped strategy that skip does not reject.
+func (hc *HealthCheckStrategy) AcquireSkip(
+	req *http.Request,
+	skip func(http.RoundTripper) bool,
+) (http.RoundTripper, error) {
+	transport, err := acquireSkipping(hc.strategy, req, func(rt http.RoundTripper) bool {
+		return skip(rt) || !hc.Healthy(rt)
+	})
+	if errors.Is(err, ErrNoTransports) {
+		return hc.adapted.AcquireRequest(req)
+	}
+
+	return transport, err
+}
+
+// Release hands the transport back to the wrapped strategy.
+func (hc *HealthCheckStrategy) Release(transport http.RoundTripper) {
+	hc.strategy.Release(transport)
+}
+
+// ReleaseResult hands the transport back to the wrapped strategy.
+func (hc *HealthCheckStrategy) ReleaseResult(transport http.RoundTripper, result Result) {
+	hc.adapted.ReleaseResult(transport, result)
+}
+
+// Transports returns the transports of the wrapped strategy.
+func (hc *HealthCheckStrategy) Transports() []http.RoundTripper {
+	return hc.lister.Transports()
+}
+
+// SetTransports replaces the transports of the wrapped strategy, which must
+// implement TransportSetter, and forgets the health of the removed ones. New
+// transports start healthy and are probed in the next round.
+func (hc *HealthCheckStrategy) SetTransports(entries []PoolEntry) {
+	setTransports(hc.strategy, entries)
+	current := listedTransports(hc.strategy)
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	retainTransports(hc.states, current)
+}
+
+// OptHealthCheckWithInterval configures the interval between probes and its random jitter.
+func OptHealthCheckWithInterval(interval, jitter time.Duration) OptHealthCheck {
+	return func(cfg *HealthCheckConfig) {
+		cfg.Interval = interval
+		cfg.Jitter = jitter
+	}
+}
+
+// OptHealthCheckWithTimeout configures the timeout of every probe.
+func OptHealthCheckWithTimeout(timeout time.Duration) OptHealthCheck {
+	return func(cfg *HealthCheckConfig) {
+		cfg.Timeout = timeout
+	}
+}
+
+// OptHealthCheckWithThresholds configures how many consecutive probes change the health of a transport.
+func OptHealthCheckWithThresholds(healthy, unhealthy int) OptHealthCheck {
+	return func(cfg *HealthCheckConfig) {
+		cfg.HealthyThreshold = healthy
+		cfg.UnhealthyThreshold = unhealthy
+	}
+}
+
+// OptHealthCheckWithEventHandler configures a callback for health changes.
+func OptHealthCheckWithEventHandler(fn func(HealthEvent)) OptHealthCheck {
+	return func(cfg *HealthCheckConfig) {
+		cfg.OnEvent = fn
+	}
+}
@@ -0,0 +1,195 @@
+package hacktheconn
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestProxy starts an httptest server standing in for an HTTP proxy. It
+// answers forwarded requests and CONNECT tunnels while healthy is set.
+func newTestProxy(t *testing.T, healthy *atomic.Bool) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		_ = buf.Flush()
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestHTTPHealthProbe(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	proxy := newTestProxy(t, &healthy)
+
+	transport, err := ProxyHTTPTransport(proxy.URL)
+	require.NoError(t, err)
+
+	probe := HTTPHealthProbe("http://health.example.com/status")
+	assert.NoError(t, probe(context.Background(), transport))
+
+	healthy.Store(false)
+	assert.Error(t, probe(context.Background(), transport))
+}
+
+func TestConnectHealthProbe(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	proxy := newTestProxy(t, &healthy)
+
+	transport, err := ProxyHTTPTransport(proxy.URL)
+	require.NoError(t, err)
+
+	probe := ConnectHealthProbe("health.example.com:443")
+	assert.NoError(t, probe(context.Background(), transport))
+
+	healthy.Store(false)
+	assert.Error(t, probe(context.Background(), transport))
+
+	// Direct transports dial the address themselves.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	direct, err := DirectTransport()
+	require.NoError(t, err)
+	assert.NoError(t, ConnectHealthProbe(listener.Addr().String())(context.Background(), direct))
+}
+
+func TestHealthCheckStrategySkipsUnhealthy(t *testing.T) {
+	var healthyA, healthyB atomic.Bool
+	healthyA.Store(true)
+	healthyB.Store(true)
+
+	transportA, err := ProxyHTTPTransport(newTestProxy(t, &healthyA).URL)
+	require.NoError(t, err)
+	transportB, err := ProxyHTTPTransport(newTestProxy(t, &healthyB).URL)
+	require.NoError(t, err)
+
+	var (
+		mutex  sync.Mutex
+		events []HealthEvent
+	)
+	s := NewHealthCheckStrategy(
+		NewRoundRobinStrategy([]http.RoundTripper{transportA, transportB}),
+		HTTPHealthProbe("http://health.example.com/status"),
+		OptHealthCheckWithThresholds(2, 2),
+		OptHealthCheckWithEventHandler(func(e HealthEvent) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, e)
+		}),
+	)
+
+	ctx := context.Background()
+
+	healthyB.Store(false)
+	s.Check(ctx)
+	assert.True(t, s.Healthy(transportB), "one failure is below the threshold")
+	s.Check(ctx)
+	assert.False(t, s.Healthy(transportB))
+
+	for range 4 {
+		transport, err := s.Acquire()
+		require.NoError(t, err)
+		assert.Same(t, transportA, transport)
+	}
+
+	healthyB.Store(true)
+	s.Check(ctx)
+	s.Check(ctx)
+	assert.True(t, s.Healthy(transportB))
+
+	require.Len(t, events, 2)
+	assert.False(t, events[0].Healthy)
+	assert.Error(t, events[0].Err)
+	assert.True(t, events[1].Healthy)
+}
+
+func TestHealthCheckStrategyStartStop(t *testing.T) {
+	var probes atomic.Int64
+	probe := func(ctx context.Context, _ http.RoundTripper) error {
+		probes.Add(1)
+		return nil
+	}
+
+	s := NewHealthCheckStrategy(
+		NewRoundRobinStrategy([]http.RoundTripper{&MockTransport{ID: "A"}}),
+		probe,
+		OptHealthCheckWithInterval(10*time.Millisecond, 0),
+	)
+
+	s.Start(context.Background())
+	s.Start(context.Background())
+	assert.Eventually(t, func() bool { return probes.Load() >= 3 }, time.Second, 5*time.Millisecond)
+	s.Stop()
+
+	stopped := probes.Load()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, stopped, probes.Load())
+
+	// Canceling the context stops the checker too.
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	cancel()
+	s.Stop()
+}
+
+func TestConnectHealthProbeThroughHTTPSProxy(t *testing.T) {
+	upstream := newUpstream(t)
+	proxy := newHTTPProxy(t, true, "user", "secret")
+	proxyURL, err := url.Parse(proxy.server.URL)
+	require.NoError(t, err)
+	proxyRoots := x509.NewCertPool()
+	proxyRoots.AddCert(proxy.server.Certificate())
+
+	probe := ConnectHealthProbe(upstream.Listener.Addr().String())
+	ctx := context.Background()
+
+	transport, err := ProxyHTTPTransport("https://user:secret@" + proxyURL.Host)
+	require.NoError(t, err)
+	assert.ErrorAs(t, probe(ctx, transport), new(*tls.CertificateVerificationError))
+
+	transport, err = ProxyHTTPTransport("https://user:secret@"+proxyURL.Host,
+		OptTransportWithProxyTLSConfig(&tls.Config{RootCAs: proxyRoots}),
+		OptTransportWithProxyConnectHeader(http.Header{"X-Session": {"abc"}}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, probe(ctx, transport))
+	assert.Equal(t, "abc", proxy.lastHeader().Get("X-Session"))
+
+	transport, err = ProxyHTTPTransport("https://user:wrong@"+proxyURL.Host,
+		OptTransportWithProxyTLSConfig(&tls.Config{RootCAs: proxyRoots}),
+	)
+	require.NoError(t, err)
+	assert.ErrorIs(t, probe(ctx, transport), ErrProxyAuthRequired)
+}
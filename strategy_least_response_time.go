@@ -1,7 +1,9 @@
 package hacktheconn
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"sync"
 	"time"
@@ -12,25 +14,96 @@ import (
 // ResponseTimeCalculator defines how response time is calculated.
 type ResponseTimeCalculator func(lastRequestDuration time.Duration) time.Duration
 
+// ResponseTimeCalculatorFactory creates the ResponseTimeCalculator of a
+// transport. Calculators may keep state, such as an average, so every
+// transport gets its own.
+type ResponseTimeCalculatorFactory func() ResponseTimeCalculator
+
+// ErrorPenalty makes LeastResponseTimeStrategy score failed requests by a
+// penalty latency instead of their actual duration, so that a transport failing
+// fast does not look fastest.
+type ErrorPenalty struct {
+	// Latency is recorded for every failed request, unless the request took
+	// longer. When zero, the request timeout, taken from the deadline of its
+	// context, is recorded instead.
+	Latency time.Duration
+	// Include5xx penalizes responses with a 5xx status code as well.
+	Include5xx bool
+}
+
 // leastResponseTimeRoundTripper tracks and calculates response times for a transport.
 type leastResponseTimeRoundTripper struct {
 	roundTripper           http.RoundTripper
 	clock                  func() time.Time
-	responseTime           time.Duration
 	responseTimeCalculator ResponseTimeCalculator
+	errorPenalty           *ErrorPenalty
+
+	mutex        sync.Mutex
+	responseTime time.Duration
 }
 
 // RoundTrip measures the time taken for a request and updates the response time.
+// The measurement spans until the response body is fully read or closed, so
+// slow or streaming bodies are accounted for.
 func (l *leastResponseTimeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := l.clock()
 
 	// Execute the actual request
 	res, err := l.roundTripper.RoundTrip(req)
+	if err != nil {
+		l.observeFailure(req, start, err)
+		return nil, err
+	}
+
+	wrapResponseBody(res, func(int64, error) {
+		if l.errorPenalty != nil && l.errorPenalty.Include5xx && res.StatusCode >= http.StatusInternalServerError {
+			l.observeFailure(req, start, nil)
+			return
+		}
+		l.observe(l.clock().Sub(start))
+	})
+
+	return res, nil
+}
+
+// observeFailure updates the response time after a failed request, applying
+// the error penalty if configured. Requests canceled by the caller are ignored
+// in that case, as they say nothing about the transport.
+func (l *leastResponseTimeRoundTripper) observeFailure(req *http.Request, start time.Time, err error) {
+	duration := l.clock().Sub(start)
+	if l.errorPenalty == nil {
+		l.observe(duration)
+		return
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return
+	}
 
-	// Update response time using the calculator
-	l.responseTime = l.responseTimeCalculator(time.Since(start))
+	penalty := l.errorPenalty.Latency
+	if penalty == 0 {
+		if deadline, ok := req.Context().Deadline(); ok {
+			penalty = deadline.Sub(start)
+		}
+	}
+
+	l.observe(max(duration, penalty))
+}
+
+// observe updates the response time using the calculator.
+func (l *leastResponseTimeRoundTripper) observe(duration time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.responseTime = l.responseTimeCalculator(duration)
+}
+
+// currentResponseTime returns the latest calculated response time.
+func (l *leastResponseTimeRoundTripper) currentResponseTime() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 
-	return res, err
+	return l.responseTime
 }
 
 func (l *leastResponseTimeRoundTripper) Unwrap() http.RoundTripper {
@@ -39,52 +112,114 @@ func (l *leastResponseTimeRoundTripper) Unwrap() http.RoundTripper {
 
 // LeastResponseTimeStrategy selects the transport with the least response time.
 type LeastResponseTimeStrategy struct {
-	transports []*leastResponseTimeRoundTripper
-	mutex      sync.Mutex
+	transports    []*leastResponseTimeRoundTripper
+	clock         func() time.Time
+	newCalculator ResponseTimeCalculatorFactory
+	errorPenalty  *ErrorPenalty
+	mutex         sync.Mutex
 }
 
 // NewLeastResponseTimeStrategy initializes the least response time strategy.
+// newCalculator creates the response time calculator of every transport.
 func NewLeastResponseTimeStrategy(
 	transports []http.RoundTripper,
 	clock func() time.Time,
-	calculator ResponseTimeCalculator,
+	newCalculator ResponseTimeCalculatorFactory,
 ) *LeastResponseTimeStrategy {
-	return &LeastResponseTimeStrategy{
-		transports: slices.Map(transports, func(rt http.RoundTripper) *leastResponseTimeRoundTripper {
-			return &leastResponseTimeRoundTripper{
-				roundTripper:           rt,
-				clock:                  clock,
-				responseTimeCalculator: calculator,
-			}
-		}),
+	lr := &LeastResponseTimeStrategy{
+		clock:         clock,
+		newCalculator: newCalculator,
 	}
+	lr.transports = slices.Map(transports, lr.wrap)
+
+	return lr
+}
+
+// wrap wraps rt to track its response time.
+func (lr *LeastResponseTimeStrategy) wrap(rt http.RoundTripper) *leastResponseTimeRoundTripper {
+	return &leastResponseTimeRoundTripper{
+		roundTripper:           rt,
+		clock:                  lr.clock,
+		responseTimeCalculator: lr.newCalculator(),
+		errorPenalty:           lr.errorPenalty,
+	}
+}
+
+// WithErrorPenalty enables error-aware scoring: failed requests are recorded
+// with the penalty latency instead of their duration. It must be called before
+// the strategy is used.
+func (lr *LeastResponseTimeStrategy) WithErrorPenalty(penalty ErrorPenalty) *LeastResponseTimeStrategy {
+	lr.errorPenalty = &penalty
+	for _, rt := range lr.transports {
+		rt.errorPenalty = &penalty
+	}
+	return lr
 }
 
 // Acquire picks the transport with the least response time.
 func (lr *LeastResponseTimeStrategy) Acquire() (http.RoundTripper, error) {
-	if len(lr.transports) == 0 {
-		return nil, ErrNoTransports
-	}
+	return lr.AcquireSkip(nil, skipNone)
+}
 
+// AcquireSkip picks the transport with the least response time that skip does not reject.
+func (lr *LeastResponseTimeStrategy) AcquireSkip(
+	_ *http.Request,
+	skip func(http.RoundTripper) bool,
+) (http.RoundTripper, error) {
 	lr.mutex.Lock()
 	defer lr.mutex.Unlock()
 
-	minIndex := 0
-	minTime := lr.transports[0].responseTime
+	minIndex := -1
+	var minTime time.Duration
 
 	for i, rt := range lr.transports {
-		if rt.responseTime < minTime {
+		if skip(rt) {
+			continue
+		}
+		if responseTime := rt.currentResponseTime(); minIndex < 0 || responseTime < minTime {
 			minIndex = i
-			minTime = rt.responseTime
+			minTime = responseTime
 		}
 	}
 
+	if minIndex < 0 {
+		return nil, ErrNoTransports
+	}
+
 	return lr.transports[minIndex], nil
 }
 
 // Release is a no-op for this strategy as response times are tracked automatically.
 func (lr *LeastResponseTimeStrategy) Release(_ http.RoundTripper) {}
 
+// Transports returns the transports the strategy selects from, wrapped to track their response time.
+func (lr *LeastResponseTimeStrategy) Transports() []http.RoundTripper {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+
+	return slices.Map(lr.transports, func(rt *leastResponseTimeRoundTripper) http.RoundTripper {
+		return rt
+	})
+}
+
+// SetTransports replaces the transports, keeping the response times of the ones that remain.
+func (lr *LeastResponseTimeStrategy) SetTransports(entries []PoolEntry) {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+
+	wrapped := make(map[http.RoundTripper]*leastResponseTimeRoundTripper, len(lr.transports))
+	for _, rt := range lr.transports {
+		wrapped[rt.roundTripper] = rt
+	}
+
+	lr.transports = slices.Map(entries, func(entry PoolEntry) *leastResponseTimeRoundTripper {
+		if rt, ok := wrapped[entry.Transport]; ok {
+			return rt
+		}
+		return lr.wrap(entry.Transport)
+	})
+}
+
 type (
 	// OptLeastResponseTime configures the LeastResponseTime strategy.
 	OptLeastResponseTime = Option[LeastResponseTimeConfig]
@@ -92,37 +227,70 @@ type (
 	LeastResponseTimeConfig struct {
 		baseStrategyConfig
 
-		clock                  func() time.Time
-		responseTimeCalculator ResponseTimeCalculator
+		clock                     func() time.Time
+		newResponseTimeCalculator ResponseTimeCalculatorFactory
+		errorPenalty              *ErrorPenalty
 	}
 )
 
 // TransportLeastResponseTime creates a StrategyTransport with configurable options.
+// Proxies whose transport cannot be created are skipped; see NewLeastResponseTime. It
+// panics if the options are invalid, e.g. with a non-positive provider interval.
 func TransportLeastResponseTime(proxies []string, opts ...OptLeastResponseTime) http.RoundTripper {
+	t, err := NewLeastResponseTime(proxies, append(opts[:len(opts):len(opts)], func(cfg *LeastResponseTimeConfig) {
+		cfg.errorPolicy = ProxyErrorPolicySkip
+	})...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// NewLeastResponseTime creates a least response time StrategyTransport with
+// configurable options. It fails with the errors of every proxy whose
+// transport cannot be created, unless another policy is set with
+// OptLeastResponseTimeWithProxyErrorPolicy.
+func NewLeastResponseTime(proxies []string, opts ...OptLeastResponseTime) (*StrategyTransport, error) {
 	cfg := &LeastResponseTimeConfig{
 		baseStrategyConfig: baseStrategyConfig{
 			Proxies:          proxies,
 			TransportFactory: DefaultTransportFactory,
 		},
-		responseTimeCalculator: LeastResponseTimeWeightedAverageCalculator(0.75),
-		clock:                  time.Now,
+		newResponseTimeCalculator: LeastResponseTimeWeightedAverageCalculator(0.75),
+		clock:                     time.Now,
 	}
 
 	for _, opt := range opts {
 		opt(cfg)
 	}
 
+	if cfg.provider != nil {
+		strategy := NewLeastResponseTimeStrategy(nil, cfg.clock, cfg.newResponseTimeCalculator)
+		if cfg.errorPenalty != nil {
+			strategy.WithErrorPenalty(*cfg.errorPenalty)
+		}
+		return cfg.providerTransport(strategy)
+	}
+
 	var transports []http.RoundTripper
-	for _, proxy := range cfg.Proxies {
-		transport, err := cfg.TransportFactory(proxy)
+	err := cfg.buildTransports(func(proxy string) error {
+		transport, err := cfg.newTransport(proxy)
 		if err != nil {
-			fmt.Printf("Error creating transport for proxy %s: %v\n", proxy, err)
-			continue
+			return err
 		}
 		transports = append(transports, transport)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return Transport(NewLeastResponseTimeStrategy(transports, cfg.clock, cfg.responseTimeCalculator))
+	strategy := NewLeastResponseTimeStrategy(transports, cfg.clock, cfg.newResponseTimeCalculator)
+	if cfg.errorPenalty != nil {
+		strategy.WithErrorPenalty(*cfg.errorPenalty)
+	}
+
+	return Transport(cfg.wrapStrategy(strategy), cfg.transportOptions()...), nil
 }
 
 // TransportDirectLeastResponseTime creates multiple direct connections using least response time strategy.
@@ -132,6 +300,34 @@ func TransportDirectLeastResponseTime(connectionCount int, opts ...OptLeastRespo
 	return TransportLeastResponseTime(directProxies, opts...)
 }
 
+// OptLeastResponseTimeWithProxyErrorPolicy configures whether
+// NewLeastResponseTime fails when the transports of some proxies cannot be
+// created, and a callback, if not nil, called with every such failure, and
+// with the failures of the proxy provider, if any.
+func OptLeastResponseTimeWithProxyErrorPolicy(policy ProxyErrorPolicy, onError func(error)) OptLeastResponseTime {
+	return func(cfg *LeastResponseTimeConfig) {
+		cfg.errorPolicy = policy
+		cfg.onProxyError = onError
+	}
+}
+
+// OptLeastResponseTimeWithLogger logs, through logger, the transport selected for every
+// request, the connections dialed by the transports, the proxies whose
+// transport fails and, with a proxy provider, the proxies added and removed.
+func OptLeastResponseTimeWithLogger(logger *slog.Logger) OptLeastResponseTime {
+	return func(cfg *LeastResponseTimeConfig) {
+		cfg.logger = logger
+	}
+}
+
+// OptLeastResponseTimeWithMetrics reports every transport selection and request
+// outcome to metrics, labeled with the proxy of the transport.
+func OptLeastResponseTimeWithMetrics(metrics Metrics) OptLeastResponseTime {
+	return func(cfg *LeastResponseTimeConfig) {
+		cfg.metrics = metrics
+	}
+}
+
 // OptLeastResponseTimeWithClock configures a custom clock function.
 func OptLeastResponseTimeWithClock(fn func() time.Time) OptLeastResponseTime {
 	return func(cfg *LeastResponseTimeConfig) {
@@ -139,18 +335,46 @@ func OptLeastResponseTimeWithClock(fn func() time.Time) OptLeastResponseTime {
 	}
 }
 
-// OptLeastResponseTimeWithCalculator configures a custom response time calculator.
-func OptLeastResponseTimeWithCalculator(calculator ResponseTimeCalculator) OptLeastResponseTime {
+// OptLeastResponseTimeWithCalculator configures a custom response time
+// calculator, created by newCalculator for every transport.
+func OptLeastResponseTimeWithCalculator(newCalculator ResponseTimeCalculatorFactory) OptLeastResponseTime {
 	return func(cfg *LeastResponseTimeConfig) {
-		cfg.responseTimeCalculator = calculator
+		cfg.newResponseTimeCalculator = newCalculator
 	}
 }
 
-// Predefined response time calculators.
+// OptLeastResponseTimeWithErrorPenalty enables error-aware scoring, recording
+// failed requests with a penalty latency instead of their duration.
+func OptLeastResponseTimeWithErrorPenalty(penalty ErrorPenalty) OptLeastResponseTime {
+	return func(cfg *LeastResponseTimeConfig) {
+		cfg.errorPenalty = &penalty
+	}
+}
+
+// OptLeastResponseTimeWithCircuitBreaker guards every transport with a circuit breaker,
+// so that transports failing fast do not attract traffic for their low response time.
+func OptLeastResponseTimeWithCircuitBreaker(opts ...OptCircuitBreaker) OptLeastResponseTime {
+	return func(cfg *LeastResponseTimeConfig) {
+		cfg.circuitBreaker = append([]OptCircuitBreaker{}, opts...)
+	}
+}
+
+// OptLeastResponseTimeWithProxyProvider feeds the proxies from provider, polled at
+// every interval, replacing the ones given to TransportLeastResponseTime once it loads.
+func OptLeastResponseTimeWithProxyProvider(provider ProxyProvider, interval time.Duration) OptLeastResponseTime {
+	return func(cfg *LeastResponseTimeConfig) {
+		cfg.provider = provider
+		cfg.providerInterval = interval
+	}
+}
+
+// Predefined response time calculator factories.
 
 // LeastResponseTimeLastResponseTimeCalculator uses the most recent response time.
-func LeastResponseTimeLastResponseTimeCalculator(lastRequestDuration time.Duration) time.Duration {
-	return lastRequestDuration
+func LeastResponseTimeLastResponseTimeCalculator() ResponseTimeCalculator {
+	return func(lastRequestDuration time.Duration) time.Duration {
+		return lastRequestDuration
+	}
 }
 
 // LeastResponseTimeMovingAverageCalculator applies a moving average for response times.
@@ -174,29 +398,31 @@ func LeastResponseTimeLastResponseTimeCalculator(lastRequestDuration time.Durati
 //	After Request 4: The oldest value (100ms) is dropped. Average = (150 + 200 + 120) / 3 = 156.67ms.
 //
 // This smooths out spikes but only considers the last n values.
-func LeastResponseTimeMovingAverageCalculator(windowSize int) ResponseTimeCalculator {
+func LeastResponseTimeMovingAverageCalculator(windowSize int) ResponseTimeCalculatorFactory {
 	if windowSize <= 0 {
 		panic("windowSize must be greater than 0")
 	}
 
-	buffer := make([]time.Duration, windowSize)
-	index := 0
-	count := 0
-	sum := time.Duration(0)
+	return func() ResponseTimeCalculator {
+		buffer := make([]time.Duration, windowSize)
+		index := 0
+		count := 0
+		sum := time.Duration(0)
 
-	return func(lastRequestDuration time.Duration) time.Duration {
-		sum -= buffer[index]
+		return func(lastRequestDuration time.Duration) time.Duration {
+			sum -= buffer[index]
 
-		buffer[index] = lastRequestDuration
-		sum += lastRequestDuration
+			buffer[index] = lastRequestDuration
+			sum += lastRequestDuration
 
-		index = (index + 1) % windowSize
+			index = (index + 1) % windowSize
 
-		if count < windowSize {
-			count++
-		}
+			if count < windowSize {
+				count++
+			}
 
-		return sum / time.Duration(count)
+			return sum / time.Duration(count)
+		}
 	}
 }
 
@@ -226,23 +452,23 @@ func LeastResponseTimeMovingAverageCalculator(windowSize int) ResponseTimeCalcul
 //	    New Average = (0.8 × 50) + (0.2 × 152) = 70.4ms.
 //
 // This method adapts faster to recent changes but never completely discards the historical influence.
-func LeastResponseTimeWeightedAverageCalculator(weight float64) ResponseTimeCalculator {
+func LeastResponseTimeWeightedAverageCalculator(weight float64) ResponseTimeCalculatorFactory {
 	if weight < 0 || weight > 1 {
 		panic("weight must be between 0 and 1")
 	}
-	previousResponseTime := time.Duration(0)
-	return func(lastRequestDuration time.Duration) time.Duration {
-		defer func() {
-			println(previousResponseTime.String())
-		}()
-		if previousResponseTime == 0 {
-			previousResponseTime = lastRequestDuration
+
+	return func() ResponseTimeCalculator {
+		previousResponseTime := time.Duration(0)
+		return func(lastRequestDuration time.Duration) time.Duration {
+			if previousResponseTime == 0 {
+				previousResponseTime = lastRequestDuration
+				return previousResponseTime
+			}
+
+			previousResponseTime = time.Duration(
+				weight*float64(lastRequestDuration) + (1-weight)*float64(previousResponseTime),
+			)
 			return previousResponseTime
 		}
-
-		previousResponseTime = time.Duration(
-			weight*float64(lastRequestDuration) + (1-weight)*float64(previousResponseTime),
-		)
-		return previousResponseTime
 	}
 }
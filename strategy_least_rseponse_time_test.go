@@ -1,11 +1,15 @@
 package hacktheconn
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLeastResponseTimeMovingAverageCalculator(t *testing.T) {
@@ -42,7 +46,7 @@ func TestLeastResponseTimeMovingAverageCalculator(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			calculator := LeastResponseTimeMovingAverageCalculator(tt.windowSize)
+			calculator := LeastResponseTimeMovingAverageCalculator(tt.windowSize)()
 			var result time.Duration
 			for _, input := range tt.inputs {
 				result = calculator(input)
@@ -93,7 +97,7 @@ func TestLeastResponseTimeWeightedAverageCalculator(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			calculator := LeastResponseTimeWeightedAverageCalculator(tt.weight)
+			calculator := LeastResponseTimeWeightedAverageCalculator(tt.weight)()
 			var result time.Duration
 			for _, input := range tt.inputs {
 				result = calculator(input)
@@ -121,7 +125,7 @@ func TestLeastResponseTimeStrategy(t *testing.T) {
 	tests := []struct {
 		name       string
 		transports []http.RoundTripper
-		calculator ResponseTimeCalculator
+		calculator ResponseTimeCalculatorFactory
 		mockDelays []time.Duration
 		expectedID int
 	}{
@@ -175,3 +179,117 @@ func TestLeastResponseTimeStrategy(t *testing.T) {
 		})
 	}
 }
+
+// brokenProxyTransport fails instantly, or answers 502 when status is set.
+type brokenProxyTransport struct {
+	status int
+}
+
+func (b *brokenProxyTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	if b.status != 0 {
+		return &http.Response{StatusCode: b.status}, nil
+	}
+	return nil, errors.New("connection refused")
+}
+
+func TestLeastResponseTimeCalculatorPerTransport(t *testing.T) {
+	lr := NewLeastResponseTimeStrategy(
+		[]http.RoundTripper{
+			&mockLeastResponseTimeTransport{ID: 1, delay: time.Millisecond},
+			&mockLeastResponseTimeTransport{ID: 2, delay: 30 * time.Millisecond},
+		},
+		time.Now,
+		LeastResponseTimeWeightedAverageCalculator(0.5),
+	)
+
+	var wg sync.WaitGroup
+	for _, transport := range lr.transports {
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 5 {
+					req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+					_, err := transport.RoundTrip(req)
+					assert.NoError(t, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	// Each transport averages its own response times.
+	assert.Less(t, lr.transports[0].currentResponseTime(), 15*time.Millisecond)
+	assert.GreaterOrEqual(t, lr.transports[1].currentResponseTime(), 30*time.Millisecond)
+}
+
+func TestLeastResponseTimeStrategyErrorPenalty(t *testing.T) {
+	tests := []struct {
+		name    string
+		broken  http.RoundTripper
+		penalty *ErrorPenalty
+		timeout time.Duration
+		avoided bool
+	}{
+		{
+			name:    "without penalty a fail-fast proxy looks fastest",
+			broken:  &brokenProxyTransport{},
+			avoided: false,
+		},
+		{
+			name:    "penalty latency",
+			broken:  &brokenProxyTransport{},
+			penalty: &ErrorPenalty{Latency: time.Second},
+			avoided: true,
+		},
+		{
+			name:    "request timeout as penalty",
+			broken:  &brokenProxyTransport{},
+			penalty: &ErrorPenalty{},
+			timeout: time.Second,
+			avoided: true,
+		},
+		{
+			name:    "5xx not penalized by default",
+			broken:  &brokenProxyTransport{status: http.StatusBadGateway},
+			penalty: &ErrorPenalty{Latency: time.Second},
+			avoided: false,
+		},
+		{
+			name:    "5xx penalized",
+			broken:  &brokenProxyTransport{status: http.StatusBadGateway},
+			penalty: &ErrorPenalty{Latency: time.Second, Include5xx: true},
+			avoided: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthy := &mockLeastResponseTimeTransport{ID: 1, delay: 10 * time.Millisecond}
+			strat := NewLeastResponseTimeStrategy(
+				[]http.RoundTripper{tt.broken, healthy},
+				time.Now,
+				LeastResponseTimeLastResponseTimeCalculator,
+			)
+			if tt.penalty != nil {
+				strat.WithErrorPenalty(*tt.penalty)
+			}
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			for _, transport := range strat.transports {
+				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://example.com", nil)
+				_, _ = transport.RoundTrip(req)
+			}
+
+			selected, err := strat.Acquire()
+			require.NoError(t, err)
+			assert.Equal(t, tt.avoided, selected.(*leastResponseTimeRoundTripper).Unwrap() == healthy)
+		})
+	}
+}
@@ -0,0 +1,428 @@
+package hacktheconn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OutlierReason tells why a transport was ejected.
+type OutlierReason string
+
+const (
+	OutlierReasonConsecutiveErrors   OutlierReason = "consecutive_errors"
+	OutlierReasonConsecutiveTimeouts OutlierReason = "consecutive_timeouts"
+	OutlierReason5xxRate             OutlierReason = "5xx_rate"
+)
+
+// OutlierEvent reports the ejection or readmission of a transport.
+type OutlierEvent struct {
+	Transport http.RoundTripper
+	// Ejected is true when the transport was ejected and false when it was readmitted.
+	Ejected bool
+	// Reason is the cause of the ejection. It is empty on readmission.
+	Reason OutlierReason
+	// Until is the time the transport stays ejected until. It is zero on readmission.
+	Until time.Time
+}
+
+// outlierState tracks the recent outcomes of a single transport.
+type outlierState struct {
+	consecutiveErrors   int
+	consecutiveTimeouts int
+	// window is a ring of the latest outcomes, true meaning a 5xx response.
+	window      []bool
+	windowIndex int
+	windowCount int
+	window5xx   int
+
+	ejections    int
+	ejectedUntil time.Time
+	readmittedAt time.Time
+}
+
+func (s *outlierState) record5xx(is5xx bool) {
+	if s.windowCount == len(s.window) {
+		if s.window[s.windowIndex] {
+			s.window5xx--
+		}
+	} else {
+		s.windowCount++
+	}
+
+	s.window[s.windowIndex] = is5xx
+	if is5xx {
+		s.window5xx++
+	}
+	s.windowIndex = (s.windowIndex + 1) % len(s.window)
+}
+
+func (s *outlierState) reset() {
+	s.consecutiveErrors = 0
+	s.consecutiveTimeouts = 0
+	s.windowIndex = 0
+	s.windowCount = 0
+	s.window5xx = 0
+	clear(s.window)
+}
+
+// OutlierDetectionStrategy wraps a strategy with passive outlier detection, in
+// the style of Envoy. It watches the outcome of every request and ejects the
+// transports that keep failing, so the wrapped strategy passes over them until
+// their ejection expires. Each ejection of the same transport lasts twice as
+// long as the previous one, up to a maximum.
+//
+// When every transport is ejected or skipped, the wrapped strategy is used as
+// is, so that requests are still attempted.
+type OutlierDetectionStrategy struct {
+	strategy Strategy
+	adapted  RequestStrategy
+	cfg      OutlierDetectionConfig
+
+	mutex  sync.Mutex
+	states map[http.RoundTripper]*outlierState
+	// listed is the number of transports of the wrapped strategy, or -1 if
+	// it cannot list them. It is counted when the transports are set, since
+	// listing them takes the lock of the wrapped strategy, which may hold it
+	// while calling ejected.
+	listed int
+}
+
+type (
+	// OptOutlierDetection configures the outlier detection.
+	OptOutlierDetection = Option[OutlierDetectionConfig]
+
+	OutlierDetectionConfig struct {
+		// ConsecutiveErrors ejects a transport after this many errors in a row.
+		// Zero disables it.
+		ConsecutiveErrors int
+		// ConsecutiveTimeouts ejects a transport after this many timeouts in a row.
+		// Zero disables it.
+		ConsecutiveTimeouts int
+		// FailureRatio5xx ejects a transport when this ratio of the last
+		// FailureRateWindow responses were 5xx, once at least
+		// FailureRateMinRequests were seen. Zero disables it.
+		FailureRatio5xx        float64
+		FailureRateWindow      int
+		FailureRateMinRequests int
+		// BaseEjectionTime is the duration of the first ejection of a transport.
+		BaseEjectionTime time.Duration
+		// MaxEjectionTime caps the duration of an ejection. A transport that
+		// stays admitted for this long has its ejection history forgotten.
+		MaxEjectionTime time.Duration
+		// MaxEjectionPercent caps the percentage of transports ejected at once.
+		MaxEjectionPercent int
+		// OnEvent is called on every ejection and readmission.
+		OnEvent func(OutlierEvent)
+
+		clock func() time.Time
+	}
+)
+
+// NewOutlierDetectionStrategy wraps s with passive outlier detection.
+func NewOutlierDetectionStrategy(s Strategy, opts ...OptOutlierDetection) *OutlierDetectionStrategy {
+	cfg := OutlierDetectionConfig{
+		ConsecutiveErrors:      5,
+		ConsecutiveTimeouts:    5,
+		FailureRatio5xx:        0.5,
+		FailureRateWindow:      100,
+		FailureRateMinRequests: 20,
+		BaseEjectionTime:       30 * time.Second,
+		MaxEjectionTime:        5 * time.Minute,
+		MaxEjectionPercent:     50,
+		clock:                  time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if cfg.FailureRateWindow <= 0 {
+		panic("failure rate window must be greater than 0")
+	}
+
+	return &OutlierDetectionStrategy{
+		strategy: s,
+		adapted:  AdaptStrategy(s),
+		cfg:      cfg,
+		states:   make(map[http.RoundTripper]*outlierState),
+		listed:   countTransports(listedTransports(s)),
+	}
+}
+
+// countTransports returns the number of transports listed by listedTransports,
+// or -1 if they could not be listed.
+func countTransports(listed map[http.RoundTripper]bool) int {
+	if listed == nil {
+		return -1
+	}
+	return len(listed)
+}
+
+// Acquire picks a transport from the wrapped strategy, passing over ejected ones.
+func (od *OutlierDetectionStrategy) Acquire() (http.RoundTripper, error) {
+	return od.AcquireSkip(nil, skipNone)
+}
+
+// AcquireRequest picks a transport for req from the wrapped strategy, passing over ejected ones.
+func (od *OutlierDetectionStrategy) AcquireRequest(req *http.Request) (http.RoundTripper, error) {
+	return od.AcquireSkip(req, skipNone)
+}
+
+// AcquireSkip picks a transport from the wrapped strategy that is neither
+// ejected nor rejected by skip.
+func (od *OutlierDetectionStrategy) AcquireSkip(
+	req *http.Request,
+	skip func(http.RoundTripper) bool,
+) (http.RoundTripper, error) {
+	transport, err := acquireSkipping(od.strategy, req, func(rt http.RoundTripper) bool {
+		return skip(rt) || od.ejected(rt)
+	})
+	if errors.Is(err, ErrNoTransports) {
+		transport, err = od.adapted.AcquireRequest(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	od.readmit(transport)
+	return transport, nil
+}
+
+// Release hands the transport back to the wrapped strategy.
+func (od *OutlierDetectionStrategy) Release(transport http.RoundTripper) {
+	od.strategy.Release(transport)
+}
+
+// ReleaseResult records the outcome of the request and hands the transport
+// back to the wrapped strategy.
+func (od *OutlierDetectionStrategy) ReleaseResult(transport http.RoundTripper, result Result) {
+	od.record(transport, result)
+	od.adapted.ReleaseResult(transport, result)
+}
+
+// Transports returns the transports of the wrapped strategy, if it can list them.
+func (od *OutlierDetectionStrategy) Transports() []http.RoundTripper {
+	if lister, ok := od.strategy.(TransportLister); ok {
+		return lister.Transports()
+	}
+	return nil
+}
+
+// SetTransports replaces the transports of the wrapped strategy, which must
+// implement TransportSetter, and forgets the state of the removed ones.
+func (od *OutlierDetectionStrategy) SetTransports(entries []PoolEntry) {
+	setTransports(od.strategy, entries)
+	current := listedTransports(od.strategy)
+
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+
+	retainTransports(od.states, current)
+	od.listed = countTransports(current)
+}
+
+// Stop stops the wrapped strategy, if it owns background goroutines.
+func (od *OutlierDetectionStrategy) Stop() {
+	stopStrategy(od.strategy)
+}
+
+// Ejected reports whether transport is currently ejected.
+func (od *OutlierDetectionStrategy) Ejected(transport http.RoundTripper) bool {
+	return od.ejected(transport)
+}
+
+// ejected reports whether the ejection of transport has not expired yet. It
+// only reads the state, since it runs while the wrapped strategy selects a
+// transport, possibly holding its lock.
+func (od *OutlierDetectionStrategy) ejected(transport http.RoundTripper) bool {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+
+	state, ok := od.states[transport]
+	return ok && od.cfg.clock().Before(state.ejectedUntil)
+}
+
+// readmit readmits the selected transport if its ejection expired.
+func (od *OutlierDetectionStrategy) readmit(transport http.RoundTripper) {
+	od.mutex.Lock()
+
+	state, ok := od.states[transport]
+	now := od.cfg.clock()
+	if !ok || state.ejectedUntil.IsZero() || now.Before(state.ejectedUntil) {
+		od.mutex.Unlock()
+		return
+	}
+
+	state.ejectedUntil = time.Time{}
+	state.readmittedAt = now
+	state.reset()
+	od.mutex.Unlock()
+
+	od.emit(OutlierEvent{Transport: transport})
+}
+
+func (od *OutlierDetectionStrategy) record(transport http.RoundTripper, result Result) {
+	// Requests canceled by the caller say nothing about the transport.
+	if errors.Is(result.Err, context.Canceled) {
+		return
+	}
+
+	od.mutex.Lock()
+
+	state := od.state(transport)
+	if !state.ejectedUntil.IsZero() {
+		od.mutex.Unlock()
+		return
+	}
+
+	switch {
+	case isTimeout(result.Err):
+		state.consecutiveTimeouts++
+		state.consecutiveErrors++
+	case result.Err != nil:
+		state.consecutiveTimeouts = 0
+		state.consecutiveErrors++
+	default:
+		state.consecutiveTimeouts = 0
+		state.consecutiveErrors = 0
+		state.record5xx(result.StatusCode >= http.StatusInternalServerError)
+	}
+
+	reason, eject := od.shouldEject(state)
+	if !eject || !od.canEject() {
+		od.mutex.Unlock()
+		return
+	}
+
+	now := od.cfg.clock()
+	if !state.readmittedAt.IsZero() && now.Sub(state.readmittedAt) > od.cfg.MaxEjectionTime {
+		state.ejections = 0
+	}
+	state.ejections++
+	duration := od.cfg.BaseEjectionTime << (state.ejections - 1)
+	if duration <= 0 || duration > od.cfg.MaxEjectionTime {
+		duration = od.cfg.MaxEjectionTime
+	}
+	state.ejectedUntil = now.Add(duration)
+	until := state.ejectedUntil
+	od.mutex.Unlock()
+
+	od.emit(OutlierEvent{Transport: transport, Ejected: true, Reason: reason, Until: until})
+}
+
+func (od *OutlierDetectionStrategy) shouldEject(state *outlierState) (OutlierReason, bool) {
+	switch {
+	case od.cfg.ConsecutiveTimeouts > 0 && state.consecutiveTimeouts >= od.cfg.ConsecutiveTimeouts:
+		return OutlierReasonConsecutiveTimeouts, true
+	case od.cfg.ConsecutiveErrors > 0 && state.consecutiveErrors >= od.cfg.ConsecutiveErrors:
+		return OutlierReasonConsecutiveErrors, true
+	case od.cfg.FailureRatio5xx > 0 &&
+		state.windowCount >= od.cfg.FailureRateMinRequests &&
+		float64(state.window5xx)/float64(state.windowCount) >= od.cfg.FailureRatio5xx:
+		return OutlierReason5xxRate, true
+	}
+	return "", false
+}
+
+// canEject reports whether one more transport may be ejected without going
+// over MaxEjectionPercent. It must be called with the mutex held.
+func (od *OutlierDetectionStrategy) canEject() bool {
+	total := od.listed
+	if total < 0 {
+		total = len(od.states)
+	}
+
+	now := od.cfg.clock()
+	ejected := 0
+	for _, state := range od.states {
+		if now.Before(state.ejectedUntil) {
+			ejected++
+		}
+	}
+
+	return (ejected+1)*100 <= total*od.cfg.MaxEjectionPercent
+}
+
+// state returns the state of transport, creating it if needed. It must be
+// called with the mutex held.
+func (od *OutlierDetectionStrategy) state(transport http.RoundTripper) *outlierState {
+	state, ok := od.states[transport]
+	if !ok {
+		state = &outlierState{window: make([]bool, od.cfg.FailureRateWindow)}
+		od.states[transport] = state
+	}
+	return state
+}
+
+func (od *OutlierDetectionStrategy) emit(event OutlierEvent) {
+	if od.cfg.OnEvent != nil {
+		od.cfg.OnEvent(event)
+	}
+}
+
+// isTimeout reports whether err is a timeout.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// OptOutlierDetectionWithConsecutiveErrors ejects transports after n errors in a row.
+func OptOutlierDetectionWithConsecutiveErrors(n int) OptOutlierDetection {
+	return func(cfg *OutlierDetectionConfig) {
+		cfg.ConsecutiveErrors = n
+	}
+}
+
+// OptOutlierDetectionWithConsecutiveTimeouts ejects transports after n timeouts in a row.
+func OptOutlierDetectionWithConsecutiveTimeouts(n int) OptOutlierDetection {
+	return func(cfg *OutlierDetectionConfig) {
+		cfg.ConsecutiveTimeouts = n
+	}
+}
+
+// OptOutlierDetectionWith5xxRate ejects transports when ratio of their last
+// window responses were 5xx, once at least minRequests were seen.
+func OptOutlierDetectionWith5xxRate(ratio float64, window, minRequests int) OptOutlierDetection {
+	return func(cfg *OutlierDetectionConfig) {
+		cfg.FailureRatio5xx = ratio
+		cfg.FailureRateWindow = window
+		cfg.FailureRateMinRequests = minRequests
+	}
+}
+
+// OptOutlierDetectionWithEjectionTime configures the base and maximum ejection durations.
+func OptOutlierDetectionWithEjectionTime(base, max time.Duration) OptOutlierDetection {
+	return func(cfg *OutlierDetectionConfig) {
+		cfg.BaseEjectionTime = base
+		cfg.MaxEjectionTime = max
+	}
+}
+
+// OptOutlierDetectionWithMaxEjectionPercent caps the percentage of transports ejected at once.
+func OptOutlierDetectionWithMaxEjectionPercent(percent int) OptOutlierDetection {
+	return func(cfg *OutlierDetectionConfig) {
+		cfg.MaxEjectionPercent = percent
+	}
+}
+
+// OptOutlierDetectionWithEventHandler configures a callback for ejections and readmissions.
+func OptOutlierDetectionWithEventHandler(fn func(OutlierEvent)) OptOutlierDetection {
+	return func(cfg *OutlierDetectionConfig) {
+		cfg.OnEvent = fn
+	}
+}
+
+// OptOutlierDetectionWithClock configures a custom clock function.
+func OptOutlierDetectionWithClock(fn func() time.Time) OptOutlierDetection {
+	return func(cfg *OutlierDetectionConfig) {
+		cfg.clock = fn
+	}
+}
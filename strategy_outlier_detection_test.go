@@ -0,0 +1,274 @@
+package hacktheconn
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newOutlierTestStrategy(now *time.Time, events *[]OutlierEvent, opts ...OptOutlierDetection) (
+	*OutlierDetectionStrategy,
+	[]http.RoundTripper,
+) {
+	transports := []http.RoundTripper{
+		&MockTransport{ID: "A"},
+		&MockTransport{ID: "B"},
+		&MockTransport{ID: "C"},
+	}
+
+	opts = append([]OptOutlierDetection{
+		OptOutlierDetectionWithClock(func() time.Time { return *now }),
+		OptOutlierDetectionWithEventHandler(func(e OutlierEvent) { *events = append(*events, e) }),
+		OptOutlierDetectionWithConsecutiveErrors(3),
+		OptOutlierDetectionWithEjectionTime(10*time.Second, time.Minute),
+	}, opts...)
+
+	return NewOutlierDetectionStrategy(NewRoundRobinStrategy(transports), opts...), transports
+}
+
+func acquireIDs(t *testing.T, s Strategy, n int) []string {
+	t.Helper()
+
+	var ids []string
+	for range n {
+		transport, err := s.Acquire()
+		require.NoError(t, err)
+		ids = append(ids, transport.(*MockTransport).ID)
+		s.Release(transport)
+	}
+	return ids
+}
+
+func TestOutlierDetectionEjectsAndReadmits(t *testing.T) {
+	now := time.Unix(0, 0)
+	var events []OutlierEvent
+	s, transports := newOutlierTestStrategy(&now, &events)
+
+	for range 3 {
+		s.ReleaseResult(transports[1], Result{Err: errors.New("connection refused")})
+	}
+
+	require.Len(t, events, 1)
+	assert.True(t, events[0].Ejected)
+	assert.Equal(t, OutlierReasonConsecutiveErrors, events[0].Reason)
+	assert.Equal(t, now.Add(10*time.Second), events[0].Until)
+	assert.True(t, s.Ejected(transports[1]))
+
+	assert.Equal(t, []string{"A", "C", "A", "C"}, acquireIDs(t, s, 4))
+
+	now = now.Add(10 * time.Second)
+	assert.Contains(t, acquireIDs(t, s, 3), "B")
+	require.Len(t, events, 2)
+	assert.False(t, events[1].Ejected)
+	assert.Same(t, transports[1], events[1].Transport)
+}
+
+func TestOutlierDetectionEjectionTimeGrows(t *testing.T) {
+	now := time.Unix(0, 0)
+	var events []OutlierEvent
+	s, transports := newOutlierTestStrategy(&now, &events)
+
+	eject := func() time.Duration {
+		for range 3 {
+			s.ReleaseResult(transports[0], Result{Err: errors.New("connection refused")})
+		}
+		until := events[len(events)-1].Until
+		duration := until.Sub(now)
+		now = until
+		assert.Contains(t, acquireIDs(t, s, 3), "A", "selecting the transport readmits it")
+		return duration
+	}
+
+	assert.Equal(t, 10*time.Second, eject())
+	assert.Equal(t, 20*time.Second, eject())
+	assert.Equal(t, 40*time.Second, eject())
+	assert.Equal(t, time.Minute, eject())
+
+	// A transport that behaves for longer than the maximum ejection time starts over.
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, 10*time.Second, eject())
+}
+
+func TestOutlierDetectionMaxEjectionPercent(t *testing.T) {
+	now := time.Unix(0, 0)
+	var events []OutlierEvent
+	s, transports := newOutlierTestStrategy(&now, &events, OptOutlierDetectionWithMaxEjectionPercent(34))
+
+	for _, transport := range transports {
+		for range 3 {
+			s.ReleaseResult(transport, Result{Err: errors.New("connection refused")})
+		}
+	}
+
+	assert.Len(t, events, 1)
+	assert.True(t, s.Ejected(transports[0]))
+	assert.False(t, s.Ejected(transports[1]))
+	assert.False(t, s.Ejected(transports[2]))
+}
+
+func TestOutlierDetectionTimeoutsAnd5xx(t *testing.T) {
+	now := time.Unix(0, 0)
+	var events []OutlierEvent
+	s, transports := newOutlierTestStrategy(&now, &events,
+		OptOutlierDetectionWithConsecutiveErrors(0),
+		OptOutlierDetectionWithConsecutiveTimeouts(2),
+		OptOutlierDetectionWith5xxRate(0.5, 10, 4),
+		OptOutlierDetectionWithMaxEjectionPercent(100),
+	)
+
+	s.ReleaseResult(transports[0], Result{Err: context.DeadlineExceeded})
+	s.ReleaseResult(transports[0], Result{Err: context.DeadlineExceeded})
+
+	for _, status := range []int{200, 503, 200, 502} {
+		s.ReleaseResult(transports[1], Result{StatusCode: status})
+	}
+
+	// Canceled requests are not the transport's fault.
+	for range 5 {
+		s.ReleaseResult(transports[2], Result{Err: context.Canceled})
+	}
+
+	require.Len(t, events, 2)
+	assert.Equal(t, OutlierReasonConsecutiveTimeouts, events[0].Reason)
+	assert.Equal(t, OutlierReason5xxRate, events[1].Reason)
+	assert.False(t, s.Ejected(transports[2]))
+}
+
+func TestOutlierDetectionFallsBackWhenAllEjected(t *testing.T) {
+	now := time.Unix(0, 0)
+	var events []OutlierEvent
+	s, transports := newOutlierTestStrategy(&now, &events, OptOutlierDetectionWithMaxEjectionPercent(100))
+
+	for _, transport := range transports {
+		for range 3 {
+			s.ReleaseResult(transport, Result{Err: errors.New("connection refused")})
+		}
+	}
+	require.Len(t, events, 3)
+
+	transport, err := s.Acquire()
+	require.NoError(t, err)
+	assert.NotNil(t, transport)
+}
+
+// unawareStrategy is a custom strategy that knows nothing about skipping.
+type unawareStrategy struct {
+	rr       *RoundRobinStrategy
+	released int
+}
+
+func (u *unawareStrategy) Acquire() (http.RoundTripper, error) { return u.rr.Acquire() }
+
+func (u *unawareStrategy) Release(http.RoundTripper) { u.released++ }
+
+func TestOutlierDetectionWrapsCustomStrategy(t *testing.T) {
+	transports := []http.RoundTripper{&MockTransport{ID: "A"}, &MockTransport{ID: "B"}}
+	inner := &unawareStrategy{rr: NewRoundRobinStrategy(transports)}
+	s := NewOutlierDetectionStrategy(inner,
+		OptOutlierDetectionWithConsecutiveErrors(1),
+		OptOutlierDetectionWithMaxEjectionPercent(100),
+	)
+
+	s.ReleaseResult(transports[0], Result{Err: errors.New("connection refused")})
+	inner.released = 0
+
+	for range 4 {
+		transport, err := s.Acquire()
+		require.NoError(t, err)
+		assert.Equal(t, "B", transport.(*MockTransport).ID)
+	}
+	// Rejected transports are handed back to the custom strategy.
+	assert.Equal(t, 4, inner.released)
+}
+
+func TestOutlierDetectionReadmitsOutsideStrategyLock(t *testing.T) {
+	now := time.Unix(0, 0)
+	transports := []http.RoundTripper{&MockTransport{ID: "A"}, &MockTransport{ID: "B"}}
+	fh := NewFillHolesStrategy(transports)
+
+	var events []OutlierEvent
+	s := NewOutlierDetectionStrategy(fh,
+		OptOutlierDetectionWithClock(func() time.Time { return now }),
+		OptOutlierDetectionWithConsecutiveErrors(1),
+		OptOutlierDetectionWithEjectionTime(10*time.Second, time.Minute),
+		OptOutlierDetectionWithEventHandler(func(e OutlierEvent) {
+			// Callbacks may use the wrapped strategy.
+			_ = fh.Transports()
+			events = append(events, e)
+		}),
+	)
+
+	s.ReleaseResult(transports[0], Result{Err: errors.New("connection refused")})
+	require.Len(t, events, 1)
+
+	// B is busy, so that fill holes picks A.
+	for range 2 {
+		_, err := fh.Acquire()
+		require.NoError(t, err)
+	}
+	fh.Release(transports[0])
+
+	now = now.Add(10 * time.Second)
+	assert.False(t, s.Ejected(transports[0]))
+	assert.Len(t, events, 1, "only selecting the transport readmits it")
+
+	acquired := make(chan http.RoundTripper)
+	go func() {
+		transport, err := s.Acquire()
+		assert.NoError(t, err)
+		acquired <- transport
+	}()
+
+	select {
+	case transport := <-acquired:
+		assert.Same(t, transports[0], transport)
+	case <-time.After(time.Second):
+		t.Fatal("acquiring deadlocked on the event handler")
+	}
+	require.Len(t, events, 2)
+	assert.False(t, events[1].Ejected)
+}
+
+func TestOutlierDetectionConcurrentFailures(t *testing.T) {
+	transports := []http.RoundTripper{
+		&MockTransport{ID: "A"},
+		&MockTransport{ID: "B"},
+		&MockTransport{ID: "C"},
+		&MockTransport{ID: "D"},
+	}
+	s := NewOutlierDetectionStrategy(NewFillHolesStrategy(transports),
+		OptOutlierDetectionWithConsecutiveErrors(1),
+		OptOutlierDetectionWithEjectionTime(time.Microsecond, time.Microsecond),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 2000 {
+					if transport, err := s.Acquire(); err == nil {
+						s.ReleaseResult(transport, Result{Err: errors.New("connection refused")})
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ejecting transports deadlocked with concurrent acquisitions")
+	}
+}
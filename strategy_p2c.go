@@ -0,0 +1,384 @@
+package hacktheconn
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// P2CScorer computes the load of a transport from its in-flight request count
+// and its peak EWMA latency. Lower scores are preferred.
+type P2CScorer func(inFlight int64, latency time.Duration) float64
+
+// DefaultP2CLatency is the latency P2CPeakEWMAScorer assumes for transports
+// without latency samples, as the default RTT estimate of linkerd.
+const DefaultP2CLatency = 30 * time.Millisecond
+
+// P2CPeakEWMAScorer is the default P2C scorer. It weighs latency by the number of
+// requests that would be queued on the transport, as in Finagle and linkerd:
+// a fast transport with many in-flight requests loses against an idle slower one.
+// Transports without latency samples are scored as if their latency were
+// DefaultP2CLatency.
+func P2CPeakEWMAScorer(inFlight int64, latency time.Duration) float64 {
+	return peakEWMAScore(inFlight, latency, DefaultP2CLatency)
+}
+
+// NewP2CPeakEWMAScorer returns a P2CPeakEWMAScorer that assumes defaultLatency
+// for transports without latency samples. A high default latency penalizes
+// them, a low one makes new transports explored first.
+func NewP2CPeakEWMAScorer(defaultLatency time.Duration) P2CScorer {
+	return func(inFlight int64, latency time.Duration) float64 {
+		return peakEWMAScore(inFlight, latency, defaultLatency)
+	}
+}
+
+func peakEWMAScore(inFlight int64, latency, defaultLatency time.Duration) float64 {
+	if latency <= 0 {
+		latency = defaultLatency
+	}
+	return float64(latency) * float64(inFlight+1)
+}
+
+// p2cTransport holds the load state of a single transport.
+type p2cTransport struct {
+	roundTripper http.RoundTripper
+	inFlight     atomic.Int64
+
+	mutex   sync.Mutex
+	latency time.Duration
+}
+
+// observe feeds duration into the peak EWMA latency: samples above the
+// current latency replace it right away, so that a transport slowing down is
+// avoided at once, while lower samples only pull it down by decay.
+func (p *p2cTransport) observe(duration time.Duration, decay float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if duration > p.latency {
+		p.latency = duration
+		return
+	}
+	p.latency = time.Duration(decay*float64(duration) + (1-decay)*float64(p.latency))
+}
+
+func (p *p2cTransport) score(scorer P2CScorer) float64 {
+	p.mutex.Lock()
+	latency := p.latency
+	p.mutex.Unlock()
+
+	return scorer(p.inFlight.Load(), latency)
+}
+
+// P2CStrategy implements the power of two choices: it picks two transports at
+// random and selects the one with the lower score. Unlike FillHolesStrategy, it
+// does not scan every transport under a global lock, which makes it suitable
+// for large pools.
+type P2CStrategy struct {
+	set    atomic.Pointer[p2cSet]
+	scorer P2CScorer
+	decay  float64
+
+	randMutex sync.Mutex
+	rand      *rand.Rand
+
+	setMutex sync.Mutex
+}
+
+// NewP2CStrategy initializes the power of two choices strategy. decay is the
+// weight of the latest sample in the peak EWMA latency when it does not exceed
+// it, between 0 and 1.
+func NewP2CStrategy(
+	transports []http.RoundTripper,
+	scorer P2CScorer,
+	decay float64,
+	source rand.Source,
+) *P2CStrategy {
+	if decay < 0 || decay > 1 {
+		panic("decay must be between 0 and 1")
+	}
+
+	p2c := &P2CStrategy{
+		scorer: scorer,
+		decay:  decay,
+		rand:   rand.New(source),
+	}
+	p2c.set.Store(newP2CSet(transports, nil))
+
+	return p2c
+}
+
+// p2cSet is an immutable set of transports, swapped as a whole by SetTransports
+// so that Acquire and Release do not need a lock.
+type p2cSet struct {
+	transports []*p2cTransport
+	index      map[http.RoundTripper]*p2cTransport
+}
+
+// newP2CSet builds a set of transports, reusing the state of the ones in previous.
+func newP2CSet(transports []http.RoundTripper, previous *p2cSet) *p2cSet {
+	set := &p2cSet{
+		transports: make([]*p2cTransport, len(transports)),
+		index:      make(map[http.RoundTripper]*p2cTransport, len(transports)),
+	}
+
+	for i, rt := range transports {
+		p, ok := previous.lookup(rt)
+		if !ok {
+			p = &p2cTransport{roundTripper: rt}
+		}
+		set.transports[i] = p
+		set.index[rt] = p
+	}
+
+	return set
+}
+
+func (s *p2cSet) lookup(transport http.RoundTripper) (*p2cTransport, bool) {
+	if s == nil {
+		return nil, false
+	}
+	p, ok := s.index[transport]
+	return p, ok
+}
+
+// Acquire picks two distinct transports at random and returns the least loaded one.
+func (p2c *P2CStrategy) Acquire() (http.RoundTripper, error) {
+	return p2c.AcquireSkip(nil, skipNone)
+}
+
+// p2cPickAttempts is how many random pairs are drawn before AcquireSkip falls
+// back to choosing among the transports skip does not reject.
+const p2cPickAttempts = 3
+
+// AcquireSkip picks two distinct transports at random, ignoring the ones skip
+// rejects, and returns the least loaded one.
+func (p2c *P2CStrategy) AcquireSkip(_ *http.Request, skip func(http.RoundTripper) bool) (http.RoundTripper, error) {
+	candidates := p2c.set.Load().transports
+
+	for attempt := 0; ; attempt++ {
+		if len(candidates) == 0 {
+			return nil, ErrNoTransports
+		}
+
+		a, b := candidates[0], candidates[0]
+		if len(candidates) > 1 {
+			i, j := p2c.pickTwo(len(candidates))
+			a, b = candidates[i], candidates[j]
+		}
+
+		switch skipA, skipB := skip(a.roundTripper), skip(b.roundTripper); {
+		case !skipA && !skipB:
+			if b.score(p2c.scorer) < a.score(p2c.scorer) {
+				a = b
+			}
+			return p2c.acquire(a), nil
+		case !skipA:
+			return p2c.acquire(a), nil
+		case !skipB:
+			return p2c.acquire(b), nil
+		}
+
+		if attempt == p2cPickAttempts-1 {
+			candidates = p2c.available(skip)
+		}
+	}
+}
+
+func (p2c *P2CStrategy) acquire(p *p2cTransport) http.RoundTripper {
+	p.inFlight.Add(1)
+	return p.roundTripper
+}
+
+// available returns the transports skip does not reject.
+func (p2c *P2CStrategy) available(skip func(http.RoundTripper) bool) []*p2cTransport {
+	var available []*p2cTransport
+	for _, p := range p2c.set.Load().transports {
+		if !skip(p.roundTripper) {
+			available = append(available, p)
+		}
+	}
+	return available
+}
+
+// pickTwo returns two distinct random indexes below n, which must be at least 2.
+func (p2c *P2CStrategy) pickTwo(n int) (int, int) {
+	p2c.randMutex.Lock()
+	defer p2c.randMutex.Unlock()
+
+	i := p2c.rand.IntN(n)
+	j := p2c.rand.IntN(n - 1)
+	if j >= i {
+		j++
+	}
+	return i, j
+}
+
+// Release decrements the in-flight count of a transport.
+func (p2c *P2CStrategy) Release(transport http.RoundTripper) {
+	if p, ok := p2c.set.Load().lookup(transport); ok {
+		p.inFlight.Add(-1)
+	}
+}
+
+// ReleaseResult decrements the in-flight count of a transport and feeds the
+// request duration into its peak EWMA latency.
+func (p2c *P2CStrategy) ReleaseResult(transport http.RoundTripper, result Result) {
+	p, ok := p2c.set.Load().lookup(transport)
+	if !ok {
+		return
+	}
+
+	p.observe(result.Duration, p2c.decay)
+	p.inFlight.Add(-1)
+}
+
+// Transports returns the transports the strategy selects from.
+func (p2c *P2CStrategy) Transports() []http.RoundTripper {
+	set := p2c.set.Load()
+
+	transports := make([]http.RoundTripper, len(set.transports))
+	for i, p := range set.transports {
+		transports[i] = p.roundTripper
+	}
+	return transports
+}
+
+// SetTransports replaces the transports, keeping the in-flight counts and
+// latencies of the ones that remain.
+func (p2c *P2CStrategy) SetTransports(entries []PoolEntry) {
+	p2c.setMutex.Lock()
+	defer p2c.setMutex.Unlock()
+
+	transports := make([]http.RoundTripper, len(entries))
+	for i, entry := range entries {
+		transports[i] = entry.Transport
+	}
+
+	p2c.set.Store(newP2CSet(transports, p2c.set.Load()))
+}
+
+type (
+	// OptP2C configures the P2C strategy.
+	OptP2C = Option[P2CConfig]
+
+	P2CConfig struct {
+		baseStrategyConfig
+
+		scorer P2CScorer
+		decay  float64
+		source rand.Source
+	}
+)
+
+// TransportP2C creates a power of two choices StrategyTransport with configurable options.
+// Proxies whose transport cannot be created are skipped; see NewP2C.
+func TransportP2C(proxies []string, opts ...OptP2C) http.RoundTripper {
+	t, _ := NewP2C(proxies, append(opts[:len(opts):len(opts)], func(cfg *P2CConfig) {
+		cfg.errorPolicy = ProxyErrorPolicySkip
+	})...)
+	return t
+}
+
+// NewP2C creates a power of two choices StrategyTransport with configurable options.
+// It fails with the errors of every proxy whose transport cannot be created,
+// unless another policy is set with OptP2CWithProxyErrorPolicy.
+func NewP2C(proxies []string, opts ...OptP2C) (*StrategyTransport, error) {
+	cfg := &P2CConfig{
+		baseStrategyConfig: baseStrategyConfig{
+			Proxies:          proxies,
+			TransportFactory: DefaultTransportFactory,
+		},
+		scorer: P2CPeakEWMAScorer,
+		decay:  0.3,
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if cfg.source == nil {
+		cfg.source = rand.NewPCG(rand.Uint64(), rand.Uint64())
+	}
+
+	var transports []http.RoundTripper
+	err := cfg.buildTransports(func(proxy string) error {
+		transport, err := cfg.newTransport(proxy)
+		if err != nil {
+			return err
+		}
+		transports = append(transports, transport)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return Transport(NewP2CStrategy(transports, cfg.scorer, cfg.decay, cfg.source), cfg.transportOptions()...), nil
+}
+
+// TransportDirectP2C creates multiple direct connections using the power of two choices strategy.
+func TransportDirectP2C(connectionCount int, opts ...OptP2C) http.RoundTripper {
+	directProxies := MultiDirectTransportFactory(connectionCount)
+
+	return TransportP2C(directProxies, opts...)
+}
+
+func OptP2CWithTransportFactory(factory func(string) (*http.Transport, error)) OptP2C {
+	return func(cfg *P2CConfig) {
+		cfg.TransportFactory = factory
+	}
+}
+
+// OptP2CWithProxyErrorPolicy configures whether NewP2C fails when the
+// transports of some proxies cannot be created, and a callback, if not nil,
+// called with every such failure.
+func OptP2CWithProxyErrorPolicy(policy ProxyErrorPolicy, onError func(error)) OptP2C {
+	return func(cfg *P2CConfig) {
+		cfg.errorPolicy = policy
+		cfg.onProxyError = onError
+	}
+}
+
+// OptP2CWithLogger logs, through logger, the transport selected for every
+// request, the connections dialed by the transports, the proxies whose
+// transport fails and, with a proxy provider, the proxies added and removed.
+func OptP2CWithLogger(logger *slog.Logger) OptP2C {
+	return func(cfg *P2CConfig) {
+		cfg.logger = logger
+	}
+}
+
+// OptP2CWithMetrics reports every transport selection and request
+// outcome to metrics, labeled with the proxy of the transport.
+func OptP2CWithMetrics(metrics Metrics) OptP2C {
+	return func(cfg *P2CConfig) {
+		cfg.metrics = metrics
+	}
+}
+
+// OptP2CWithScorer configures a custom scoring function.
+func OptP2CWithScorer(scorer P2CScorer) OptP2C {
+	return func(cfg *P2CConfig) {
+		cfg.scorer = scorer
+	}
+}
+
+// OptP2CWithDecay configures the weight of the latest sample in the peak EWMA
+// latency when it does not exceed it.
+func OptP2CWithDecay(decay float64) OptP2C {
+	return func(cfg *P2CConfig) {
+		cfg.decay = decay
+	}
+}
+
+// OptP2CWithRandSource configures the random source used to pick candidates.
+// Use a seeded source, e.g. rand.NewPCG(1, 2), for deterministic selection.
+func OptP2CWithRandSource(source rand.Source) OptP2C {
+	return func(cfg *P2CConfig) {
+		cfg.source = source
+	}
+}
@@ -0,0 +1,125 @@
+package hacktheconn
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestP2CPeakEWMAScorer(t *testing.T) {
+	assert.Equal(t, float64(DefaultP2CLatency), P2CPeakEWMAScorer(0, 0))
+	assert.Equal(t, float64(4*DefaultP2CLatency), P2CPeakEWMAScorer(3, 0))
+	assert.Less(t,
+		P2CPeakEWMAScorer(0, 100*time.Millisecond),
+		P2CPeakEWMAScorer(3, 50*time.Millisecond),
+	)
+}
+
+func TestP2CPeakEWMAScorerUnmeasuredTransport(t *testing.T) {
+	// An unmeasured transport with in-flight requests is not preferred over
+	// an idle measured one, whose latency is not that much lower.
+	assert.Less(t,
+		P2CPeakEWMAScorer(0, 50*time.Millisecond),
+		P2CPeakEWMAScorer(3, 0),
+	)
+	assert.Less(t,
+		P2CPeakEWMAScorer(1, 10*time.Millisecond),
+		P2CPeakEWMAScorer(1, 0),
+	)
+
+	penalty := NewP2CPeakEWMAScorer(time.Second)
+	assert.Less(t, penalty(3, 200*time.Millisecond), penalty(0, 0))
+	assert.Equal(t, float64(2*time.Second), penalty(1, 0))
+}
+
+func TestP2CTransportPeakEWMA(t *testing.T) {
+	p := &p2cTransport{}
+
+	p.observe(10*time.Millisecond, 0.5)
+	assert.Equal(t, 10*time.Millisecond, p.latency)
+
+	p.observe(500*time.Millisecond, 0.5)
+	assert.Equal(t, 500*time.Millisecond, p.latency, "slower samples are taken right away")
+
+	p.observe(100*time.Millisecond, 0.5)
+	assert.Equal(t, 300*time.Millisecond, p.latency, "faster samples decay the latency")
+	p.observe(100*time.Millisecond, 0.5)
+	assert.Equal(t, 200*time.Millisecond, p.latency)
+}
+
+func TestP2CStrategyDeterministic(t *testing.T) {
+	transports := []http.RoundTripper{
+		&MockTransport{ID: "A"},
+		&MockTransport{ID: "B"},
+		&MockTransport{ID: "C"},
+		&MockTransport{ID: "D"},
+	}
+
+	pick := func() []string {
+		s := NewP2CStrategy(transports, P2CPeakEWMAScorer, 0.5, rand.NewPCG(1, 2))
+		var ids []string
+		for range 20 {
+			transport, err := s.Acquire()
+			require.NoError(t, err)
+			ids = append(ids, transport.(*MockTransport).ID)
+			s.Release(transport)
+		}
+		return ids
+	}
+
+	assert.Equal(t, pick(), pick())
+}
+
+func TestP2CStrategyPrefersLowerScore(t *testing.T) {
+	transports := []http.RoundTripper{
+		&MockTransport{ID: "A"},
+		&MockTransport{ID: "B"},
+	}
+
+	s := NewP2CStrategy(transports, P2CPeakEWMAScorer, 1, rand.NewPCG(1, 2))
+	s.set.Load().transports[0].observe(500*time.Millisecond, 1)
+	s.set.Load().transports[1].observe(10*time.Millisecond, 1)
+
+	for range 5 {
+		transport, err := s.Acquire()
+		require.NoError(t, err)
+		assert.Equal(t, "B", transport.(*MockTransport).ID)
+	}
+	assert.Equal(t, int64(5), s.set.Load().transports[1].inFlight.Load())
+
+	// With enough requests queued on B, the idle slower A wins.
+	for range 50 {
+		_, _ = s.Acquire()
+	}
+	assert.Positive(t, s.set.Load().transports[0].inFlight.Load())
+}
+
+func TestP2CStrategyCustomScorer(t *testing.T) {
+	transports := []http.RoundTripper{
+		&MockTransport{ID: "A"},
+		&MockTransport{ID: "B"},
+		&MockTransport{ID: "C"},
+	}
+
+	// Only the in-flight count matters, so requests spread evenly.
+	inFlightOnly := func(inFlight int64, _ time.Duration) float64 { return float64(inFlight) }
+	s := NewP2CStrategy(transports, inFlightOnly, 0.5, rand.NewPCG(3, 4))
+
+	for range 30 {
+		_, err := s.Acquire()
+		require.NoError(t, err)
+	}
+
+	for _, p := range s.set.Load().transports {
+		assert.InDelta(t, 10, p.inFlight.Load(), 2)
+	}
+}
+
+func TestP2CStrategyNoTransports(t *testing.T) {
+	_, err := NewP2CStrategy(nil, P2CPeakEWMAScorer, 0.5, rand.NewPCG(1, 2)).Acquire()
+	assert.ErrorIs(t, err, ErrNoTransports)
+}
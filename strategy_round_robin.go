@@ -1,9 +1,11 @@
 package hacktheconn
 
 import (
-	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
 	"sync"
+	"time"
 )
 
 // RoundRobinStrategy manages round-robin selection.
@@ -23,19 +25,54 @@ func NewRoundRobinStrategy(transports []http.RoundTripper) *RoundRobinStrategy {
 
 // Acquire picks the next transport in a round-robin manner.
 func (rr *RoundRobinStrategy) Acquire() (http.RoundTripper, error) {
-	if len(rr.transports) == 0 {
-		return nil, ErrNoTransports
-	}
+	return rr.AcquireSkip(nil, skipNone)
+}
 
+// AcquireSkip picks the next transport in a round-robin manner that skip does not reject.
+func (rr *RoundRobinStrategy) AcquireSkip(_ *http.Request, skip func(http.RoundTripper) bool) (http.RoundTripper, error) {
 	rr.mutex.Lock()
 	defer rr.mutex.Unlock()
 
-	rr.lastSelected = (rr.lastSelected + 1) % len(rr.transports)
-	return rr.transports[rr.lastSelected], nil
+	for range rr.transports {
+		rr.lastSelected = (rr.lastSelected + 1) % len(rr.transports)
+		if transport := rr.transports[rr.lastSelected]; !skip(transport) {
+			return transport, nil
+		}
+	}
+
+	return nil, ErrNoTransports
 }
 
 func (rr *RoundRobinStrategy) Release(http.RoundTripper) {}
 
+// Transports returns the transports the strategy selects from.
+func (rr *RoundRobinStrategy) Transports() []http.RoundTripper {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	return rr.transports
+}
+
+// SetTransports replaces the transports, resuming the rotation after the last
+// selected one if it remains.
+func (rr *RoundRobinStrategy) SetTransports(entries []PoolEntry) {
+	transports := make([]http.RoundTripper, len(entries))
+	for i, entry := range entries {
+		transports[i] = entry.Transport
+	}
+
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	lastSelected := -1
+	if rr.lastSelected >= 0 && rr.lastSelected < len(rr.transports) {
+		lastSelected = slices.Index(transports, rr.transports[rr.lastSelected])
+	}
+
+	rr.transports = transports
+	rr.lastSelected = lastSelected
+}
+
 type (
 	OptRoundRobin = Option[RoundRobinConfig]
 
@@ -45,7 +82,22 @@ type (
 )
 
 // TransportRoundRobin creates a round-robin StrategyTransport with configurable options.
+// Proxies whose transport cannot be created are skipped; see NewRoundRobin. It
+// panics if the options are invalid, e.g. with a non-positive provider interval.
 func TransportRoundRobin(proxies []string, opts ...OptRoundRobin) http.RoundTripper {
+	t, err := NewRoundRobin(proxies, append(opts[:len(opts):len(opts)], func(cfg *RoundRobinConfig) {
+		cfg.errorPolicy = ProxyErrorPolicySkip
+	})...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// NewRoundRobin creates a round-robin StrategyTransport with configurable options.
+// It fails with the errors of every proxy whose transport cannot be created,
+// unless another policy is set with OptRoundRobinWithProxyErrorPolicy.
+func NewRoundRobin(proxies []string, opts ...OptRoundRobin) (*StrategyTransport, error) {
 	cfg := &RoundRobinConfig{
 		baseStrategyConfig{
 			Proxies:          proxies,
@@ -57,17 +109,24 @@ func TransportRoundRobin(proxies []string, opts ...OptRoundRobin) http.RoundTrip
 		opt(cfg)
 	}
 
+	if cfg.provider != nil {
+		return cfg.providerTransport(NewRoundRobinStrategy(nil))
+	}
+
 	var transports []http.RoundTripper
-	for _, proxy := range cfg.Proxies {
-		transport, err := cfg.TransportFactory(proxy)
+	err := cfg.buildTransports(func(proxy string) error {
+		transport, err := cfg.newTransport(proxy)
 		if err != nil {
-			fmt.Printf("Error creating transport for proxy %s: %v\n", proxy, err)
-			continue
+			return err
 		}
 		transports = append(transports, transport)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return Transport(NewRoundRobinStrategy(transports))
+	return Transport(cfg.wrapStrategy(NewRoundRobinStrategy(transports)), cfg.transportOptions()...), nil
 }
 
 func OptRoundRobinWithTransportFactory(factory func(string) (*http.Transport, error)) OptRoundRobin {
@@ -76,6 +135,50 @@ func OptRoundRobinWithTransportFactory(factory func(string) (*http.Transport, er
 	}
 }
 
+// OptRoundRobinWithCircuitBreaker guards every transport with a circuit breaker.
+func OptRoundRobinWithCircuitBreaker(opts ...OptCircuitBreaker) OptRoundRobin {
+	return func(cfg *RoundRobinConfig) {
+		cfg.circuitBreaker = append([]OptCircuitBreaker{}, opts...)
+	}
+}
+
+// OptRoundRobinWithProxyProvider feeds the proxies from provider, polled at every
+// interval, replacing the ones given to TransportRoundRobin once it loads.
+func OptRoundRobinWithProxyProvider(provider ProxyProvider, interval time.Duration) OptRoundRobin {
+	return func(cfg *RoundRobinConfig) {
+		cfg.provider = provider
+		cfg.providerInterval = interval
+	}
+}
+
+// OptRoundRobinWithProxyErrorPolicy configures whether NewRoundRobin fails when
+// the transports of some proxies cannot be created, and a callback, if not
+// nil, called with every such failure, and with the failures of the proxy
+// provider, if any.
+func OptRoundRobinWithProxyErrorPolicy(policy ProxyErrorPolicy, onError func(error)) OptRoundRobin {
+	return func(cfg *RoundRobinConfig) {
+		cfg.errorPolicy = policy
+		cfg.onProxyError = onError
+	}
+}
+
+// OptRoundRobinWithLogger logs, through logger, the transport selected for every
+// request, the connections dialed by the transports, the proxies whose
+// transport fails and, with a proxy provider, the proxies added and removed.
+func OptRoundRobinWithLogger(logger *slog.Logger) OptRoundRobin {
+	return func(cfg *RoundRobinConfig) {
+		cfg.logger = logger
+	}
+}
+
+// OptRoundRobinWithMetrics reports every transport selection and request
+// outcome to metrics, labeled with the proxy of the transport.
+func OptRoundRobinWithMetrics(metrics Metrics) OptRoundRobin {
+	return func(cfg *RoundRobinConfig) {
+		cfg.metrics = metrics
+	}
+}
+
 // TransportDirectRoundRobin creates multiple direct connections using round-robin strategy.
 // This is useful when you're behind a load balancer and want multiple TCP connections
 // to take advantage of upstream rebalancing.
@@ -0,0 +1,254 @@
+package hacktheconn
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bodyTransport is a mock http.RoundTripper returning a fixed response body.
+type bodyTransport struct {
+	ID   string
+	body string
+}
+
+func (m *bodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(m.body)),
+		Request:    req,
+	}, nil
+}
+
+// recordingStrategy records the results it is released with.
+type recordingStrategy struct {
+	transport http.RoundTripper
+	results   []Result
+}
+
+func (r *recordingStrategy) Acquire() (http.RoundTripper, error) { return r.transport, nil }
+
+func (r *recordingStrategy) AcquireRequest(*http.Request) (http.RoundTripper, error) {
+	return r.transport, nil
+}
+
+func (r *recordingStrategy) Release(http.RoundTripper) {}
+
+func (r *recordingStrategy) ReleaseResult(_ http.RoundTripper, result Result) {
+	r.results = append(r.results, result)
+}
+
+func TestStrategyTransportReleasesOnBodyClose(t *testing.T) {
+	transports := []http.RoundTripper{
+		&bodyTransport{ID: "A", body: "hello"},
+		&bodyTransport{ID: "B", body: "hello"},
+	}
+	s := NewFillHolesStrategy(transports)
+	tr := Transport(s)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	res, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+
+	// The response body is still open, so the transport must remain busy.
+	assert.Equal(t, []int{1, 0}, s.requestCounts)
+
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, []int{0, 0}, s.requestCounts)
+
+	// Closing twice must not release twice.
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, []int{0, 0}, s.requestCounts)
+}
+
+func TestStrategyTransportReleasesOnEOFWithResult(t *testing.T) {
+	s := &recordingStrategy{transport: &bodyTransport{ID: "A", body: "hello world"}}
+	tr := Transport(s)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	res, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Empty(t, s.results)
+
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	require.Len(t, s.results, 1)
+	assert.Equal(t, int64(len("hello world")), s.results[0].BytesRead)
+	assert.NoError(t, s.results[0].Err)
+
+	require.NoError(t, res.Body.Close())
+	assert.Len(t, s.results, 1)
+}
+
+func TestStrategyTransportReleasesOnError(t *testing.T) {
+	s := &recordingStrategy{transport: &MockTransport{ID: "A"}}
+	tr := Transport(s)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	_, err := tr.RoundTrip(req)
+	require.Error(t, err)
+
+	require.Len(t, s.results, 1)
+	assert.Equal(t, err, s.results[0].Err)
+}
+
+// slowBodyTransport returns a body whose reads advance a fake clock.
+type slowBodyTransport struct {
+	now *time.Time
+}
+
+type slowBody struct {
+	now  *time.Time
+	left int
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if b.left == 0 {
+		return 0, io.EOF
+	}
+	*b.now = b.now.Add(100 * time.Millisecond)
+	b.left--
+	p[0] = 'x'
+	return 1, nil
+}
+
+func (b *slowBody) Close() error { return nil }
+
+func (m *slowBodyTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: &slowBody{now: m.now, left: 3}}, nil
+}
+
+func TestLeastResponseTimeAccountsForBodyLifetime(t *testing.T) {
+	now := time.Unix(0, 0)
+	clock := func() time.Time { return now }
+
+	s := NewLeastResponseTimeStrategy(
+		[]http.RoundTripper{&slowBodyTransport{now: &now}},
+		clock,
+		LeastResponseTimeLastResponseTimeCalculator,
+	)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	res, err := s.transports[0].RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), s.transports[0].currentResponseTime())
+
+	_, err = io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 300*time.Millisecond, s.transports[0].currentResponseTime())
+}
+
+// hostStrategy is a request-aware strategy routing requests by host.
+type hostStrategy struct {
+	byHost  map[string]http.RoundTripper
+	results []Result
+}
+
+func (h *hostStrategy) AcquireRequest(req *http.Request) (http.RoundTripper, error) {
+	transport, ok := h.byHost[req.URL.Host]
+	if !ok {
+		return nil, ErrNoTransports
+	}
+	return transport, nil
+}
+
+func (h *hostStrategy) ReleaseResult(_ http.RoundTripper, result Result) {
+	h.results = append(h.results, result)
+}
+
+func TestTransportRequestStrategy(t *testing.T) {
+	s := &hostStrategy{byHost: map[string]http.RoundTripper{
+		"a.example.com": &bodyTransport{ID: "A", body: "a"},
+		"b.example.com": &bodyTransport{ID: "B", body: "b"},
+	}}
+	tr := TransportRequestStrategy(s)
+
+	for _, host := range []string{"a", "b"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+host+".example.com", nil)
+		res, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, host, string(data))
+	}
+
+	require.Len(t, s.results, 2)
+	assert.Equal(t, http.StatusOK, s.results[0].StatusCode)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://c.example.com", nil)
+	_, err := tr.RoundTrip(req)
+	assert.ErrorIs(t, err, ErrNoTransports)
+}
+
+func TestAdaptStrategy(t *testing.T) {
+	rr := NewRoundRobinStrategy([]http.RoundTripper{&MockTransport{ID: "A"}})
+	adapted := AdaptStrategy(rr)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	transport, err := adapted.AcquireRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "A", transport.(*MockTransport).ID)
+	adapted.ReleaseResult(transport, Result{})
+
+	// Strategies that already are request-aware are returned untouched.
+	recording := &recordingStrategy{}
+	assert.Same(t, recording, AdaptStrategy(recording))
+}
+
+func TestStrategyTransportHonorsCanceledContext(t *testing.T) {
+	s := NewFillHolesStrategy([]http.RoundTripper{&bodyTransport{ID: "A"}})
+	tr := Transport(s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+	_, err := tr.RoundTrip(req)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []int{0}, s.requestCounts)
+}
+
+// drainingTransport reads the request body before answering with a status code.
+type drainingTransport struct {
+	statusCode int
+}
+
+func (m *drainingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_, _ = io.Copy(io.Discard, req.Body)
+		_ = req.Body.Close()
+	}
+	return &http.Response{StatusCode: m.statusCode, Body: http.NoBody}, nil
+}
+
+func TestStrategyTransportReleasesOutcome(t *testing.T) {
+	s := &recordingStrategy{transport: &drainingTransport{statusCode: http.StatusBadGateway}}
+	tr := Transport(s)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("payload"))
+	res, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	require.Len(t, s.results, 1)
+	result := s.results[0]
+	assert.Equal(t, http.StatusBadGateway, result.StatusCode)
+	assert.Equal(t, int64(len("payload")), result.BytesWritten)
+	assert.True(t, result.Failed())
+}
+
+func TestResultFailed(t *testing.T) {
+	assert.False(t, Result{StatusCode: http.StatusOK}.Failed())
+	assert.False(t, Result{StatusCode: http.StatusNotFound}.Failed())
+	assert.True(t, Result{StatusCode: http.StatusServiceUnavailable}.Failed())
+	assert.True(t, Result{Err: io.ErrUnexpectedEOF}.Failed())
+}
@@ -0,0 +1,247 @@
+package hacktheconn
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// DefaultWeight is the weight assigned to transports without an explicit one.
+const DefaultWeight = 1
+
+// WeightedRoundRobinStrategy manages smooth weighted round-robin selection, as
+// implemented by nginx. Transports are picked proportionally to their weight
+// while interleaving them as evenly as possible: weights {5, 1, 1} yield
+// A A B A C A A rather than A A A A A B C.
+type WeightedRoundRobinStrategy struct {
+	transports     []http.RoundTripper
+	weights        []int
+	currentWeights []int
+	mutex          sync.Mutex
+}
+
+// NewWeightedRoundRobinStrategy initializes the weighted round-robin strategy.
+// weights[i] is the weight of transports[i]. Missing or non-positive weights
+// default to DefaultWeight.
+func NewWeightedRoundRobinStrategy(transports []http.RoundTripper, weights []int) *WeightedRoundRobinStrategy {
+	wrr := &WeightedRoundRobinStrategy{
+		transports:     transports,
+		weights:        make([]int, len(transports)),
+		currentWeights: make([]int, len(transports)),
+	}
+
+	for i := range transports {
+		weight := DefaultWeight
+		if i < len(weights) && weights[i] > 0 {
+			weight = weights[i]
+		}
+		wrr.weights[i] = weight
+	}
+
+	return wrr
+}
+
+// Acquire picks the next transport in a smooth weighted round-robin manner.
+func (wrr *WeightedRoundRobinStrategy) Acquire() (http.RoundTripper, error) {
+	return wrr.AcquireSkip(nil, skipNone)
+}
+
+// AcquireSkip picks the next transport in a smooth weighted round-robin manner,
+// leaving out the transports skip rejects.
+func (wrr *WeightedRoundRobinStrategy) AcquireSkip(
+	_ *http.Request,
+	skip func(http.RoundTripper) bool,
+) (http.RoundTripper, error) {
+	wrr.mutex.Lock()
+	defer wrr.mutex.Unlock()
+
+	selected := -1
+	totalWeight := 0
+	for i, weight := range wrr.weights {
+		if skip(wrr.transports[i]) {
+			continue
+		}
+		wrr.currentWeights[i] += weight
+		totalWeight += weight
+		if selected < 0 || wrr.currentWeights[i] > wrr.currentWeights[selected] {
+			selected = i
+		}
+	}
+
+	if selected < 0 {
+		return nil, ErrNoTransports
+	}
+
+	wrr.currentWeights[selected] -= totalWeight
+	return wrr.transports[selected], nil
+}
+
+func (wrr *WeightedRoundRobinStrategy) Release(http.RoundTripper) {}
+
+// Transports returns the transports the strategy selects from.
+func (wrr *WeightedRoundRobinStrategy) Transports() []http.RoundTripper {
+	wrr.mutex.Lock()
+	defer wrr.mutex.Unlock()
+
+	return wrr.transports
+}
+
+// SetTransports replaces the transports and their weights, keeping the current
+// weights of the ones that remain.
+func (wrr *WeightedRoundRobinStrategy) SetTransports(entries []PoolEntry) {
+	wrr.mutex.Lock()
+	defer wrr.mutex.Unlock()
+
+	currentWeights := make(map[http.RoundTripper]int, len(wrr.transports))
+	for i, transport := range wrr.transports {
+		currentWeights[transport] = wrr.currentWeights[i]
+	}
+
+	wrr.transports = make([]http.RoundTripper, len(entries))
+	wrr.weights = make([]int, len(entries))
+	wrr.currentWeights = make([]int, len(entries))
+	for i, entry := range entries {
+		wrr.transports[i] = entry.Transport
+		wrr.weights[i] = entry.Weight
+		if wrr.weights[i] <= 0 {
+			wrr.weights[i] = DefaultWeight
+		}
+		wrr.currentWeights[i] = currentWeights[entry.Transport]
+	}
+}
+
+type (
+	OptWeightedRoundRobin = Option[WeightedRoundRobinConfig]
+
+	WeightedRoundRobinConfig struct {
+		baseStrategyConfig
+
+		// Weights maps proxy URLs, as given to TransportWeightedRoundRobin, to
+		// their weight. It takes precedence over the weight query parameter.
+		Weights map[string]int
+	}
+)
+
+// TransportWeightedRoundRobin creates a smooth weighted round-robin StrategyTransport.
+// The weight of each proxy is read from its "weight" query parameter, e.g.
+// "http://proxy1.example.com?weight=5", or set with OptWeightedRoundRobinWithWeight.
+// The parameter is stripped before the URL reaches the transport factory.
+// Proxies whose transport cannot be created are skipped; see NewWeightedRoundRobin.
+func TransportWeightedRoundRobin(proxies []string, opts ...OptWeightedRoundRobin) http.RoundTripper {
+	t, _ := NewWeightedRoundRobin(proxies, append(opts[:len(opts):len(opts)], func(cfg *WeightedRoundRobinConfig) {
+		cfg.errorPolicy = ProxyErrorPolicySkip
+	})...)
+	return t
+}
+
+// NewWeightedRoundRobin creates a smooth weighted round-robin StrategyTransport
+// like TransportWeightedRoundRobin. It fails with the errors of every proxy
+// whose weight or transport is invalid, unless another policy is set with
+// OptWeightedRoundRobinWithProxyErrorPolicy.
+func NewWeightedRoundRobin(proxies []string, opts ...OptWeightedRoundRobin) (*StrategyTransport, error) {
+	cfg := &WeightedRoundRobinConfig{
+		baseStrategyConfig: baseStrategyConfig{
+			Proxies:          proxies,
+			TransportFactory: DefaultTransportFactory,
+		},
+		Weights: make(map[string]int),
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	var (
+		transports []http.RoundTripper
+		weights    []int
+	)
+	err := cfg.buildTransports(func(proxy string) error {
+		proxyURL, weight, err := parseProxyWeight(proxy)
+		if err != nil {
+			return err
+		}
+		if w, ok := cfg.Weights[proxy]; ok {
+			weight = w
+		}
+
+		transport, err := cfg.newTransport(proxyURL)
+		if err != nil {
+			return err
+		}
+		transports = append(transports, transport)
+		weights = append(weights, weight)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return Transport(NewWeightedRoundRobinStrategy(transports, weights), cfg.transportOptions()...), nil
+}
+
+func OptWeightedRoundRobinWithTransportFactory(factory func(string) (*http.Transport, error)) OptWeightedRoundRobin {
+	return func(cfg *WeightedRoundRobinConfig) {
+		cfg.TransportFactory = factory
+	}
+}
+
+// OptWeightedRoundRobinWithProxyErrorPolicy configures whether
+// NewWeightedRoundRobin fails when the weights or transports of some proxies
+// are invalid, and a callback, if not nil, called with every such failure.
+func OptWeightedRoundRobinWithProxyErrorPolicy(policy ProxyErrorPolicy, onError func(error)) OptWeightedRoundRobin {
+	return func(cfg *WeightedRoundRobinConfig) {
+		cfg.errorPolicy = policy
+		cfg.onProxyError = onError
+	}
+}
+
+// OptWeightedRoundRobinWithLogger logs, through logger, the transport selected for every
+// request, the connections dialed by the transports, the proxies whose
+// transport fails and, with a proxy provider, the proxies added and removed.
+func OptWeightedRoundRobinWithLogger(logger *slog.Logger) OptWeightedRoundRobin {
+	return func(cfg *WeightedRoundRobinConfig) {
+		cfg.logger = logger
+	}
+}
+
+// OptWeightedRoundRobinWithMetrics reports every transport selection and request
+// outcome to metrics, labeled with the proxy of the transport.
+func OptWeightedRoundRobinWithMetrics(metrics Metrics) OptWeightedRoundRobin {
+	return func(cfg *WeightedRoundRobinConfig) {
+		cfg.metrics = metrics
+	}
+}
+
+// OptWeightedRoundRobinWithWeight sets the weight of a single proxy entry.
+func OptWeightedRoundRobinWithWeight(proxy string, weight int) OptWeightedRoundRobin {
+	return func(cfg *WeightedRoundRobinConfig) {
+		cfg.Weights[proxy] = weight
+	}
+}
+
+// parseProxyWeight extracts the "weight" query parameter from a proxy URL and
+// returns the URL without it.
+func parseProxyWeight(proxy string) (string, int, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "", 0, err
+	}
+
+	query := u.Query()
+	if !query.Has("weight") {
+		return proxy, DefaultWeight, nil
+	}
+
+	weight, err := strconv.Atoi(query.Get("weight"))
+	if err != nil || weight <= 0 {
+		return "", 0, fmt.Errorf("invalid weight %q", query.Get("weight"))
+	}
+
+	query.Del("weight")
+	u.RawQuery = query.Encode()
+
+	return u.String(), weight, nil
+}
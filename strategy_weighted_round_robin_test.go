@@ -0,0 +1,86 @@
+package hacktheconn
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeightedRoundRobinStrategy(t *testing.T) {
+	transports := []http.RoundTripper{
+		&MockTransport{ID: "A"},
+		&MockTransport{ID: "B"},
+		&MockTransport{ID: "C"},
+	}
+
+	s := NewWeightedRoundRobinStrategy(transports, []int{5, 1, 1})
+
+	var ids []string
+	for range 14 {
+		transport, err := s.Acquire()
+		require.NoError(t, err)
+		ids = append(ids, transport.(*MockTransport).ID)
+	}
+
+	assert.Equal(t, "AABACAAAABACAA", strings.Join(ids, ""))
+}
+
+func TestWeightedRoundRobinStrategyDefaultsWeights(t *testing.T) {
+	transports := []http.RoundTripper{
+		&MockTransport{ID: "A"},
+		&MockTransport{ID: "B"},
+	}
+
+	s := NewWeightedRoundRobinStrategy(transports, []int{0})
+
+	var ids []string
+	for range 4 {
+		transport, err := s.Acquire()
+		require.NoError(t, err)
+		ids = append(ids, transport.(*MockTransport).ID)
+	}
+
+	assert.Equal(t, "ABAB", strings.Join(ids, ""))
+}
+
+func TestWeightedRoundRobinStrategyNoTransports(t *testing.T) {
+	_, err := NewWeightedRoundRobinStrategy(nil, nil).Acquire()
+	assert.ErrorIs(t, err, ErrNoTransports)
+}
+
+func TestParseProxyWeight(t *testing.T) {
+	tests := []struct {
+		name     string
+		proxy    string
+		expected string
+		weight   int
+		wantErr  bool
+	}{
+		{name: "no weight", proxy: "http://proxy.example.com", expected: "http://proxy.example.com", weight: 1},
+		{name: "weight", proxy: "http://proxy.example.com?weight=5", expected: "http://proxy.example.com", weight: 5},
+		{
+			name:     "weight with other params",
+			proxy:    "socks5://proxy.example.com:1080?country=es&weight=3",
+			expected: "socks5://proxy.example.com:1080?country=es",
+			weight:   3,
+		},
+		{name: "invalid weight", proxy: "http://proxy.example.com?weight=abc", wantErr: true},
+		{name: "zero weight", proxy: "http://proxy.example.com?weight=0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, weight, err := parseProxyWeight(tt.proxy)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, proxy)
+			assert.Equal(t, tt.weight, weight)
+		})
+	}
+}
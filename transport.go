@@ -1,31 +1,67 @@
 package hacktheconn
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 )
 
-// DefaultTransportFactory creates a transport based on the provided proxy URL.
-// It supports "http", "https", "direct", and SOCKS5 protocols.
-// If the scheme is "http" or "https", it uses ProxyHTTPTransport.
-// If the scheme is "direct", it uses DirectTransport.
-// For any other scheme, it defaults to ProxySocks5Transport.
+// DefaultTransportFactory creates a transport based on the provided proxy URL,
+// with the built-in schemes of NewTransportRegistry.
+// If the scheme is "http" or "https", it uses ProxyHTTPTransport, speaking TLS
+// to the proxy itself with "https".
+// If the scheme is "socks5" or "socks5h", it uses ProxySocks5Transport.
+// If the scheme is "direct", it uses DirectTransport, or PinnedDirectTransport
+// when a host is given, as in "direct://10.0.0.1:443". The bind query
+// parameter binds connections to a local IP address, as in
+// "direct://?bind=10.0.0.5", for which "local://10.0.0.5" is a shorthand.
+// If the scheme is "unix", it uses UnixSocketTransport.
 // This is useful for dynamically selecting transports based on the proxy URL.
-// It returns an error if the proxy URL is invalid.
+// It returns an error if the proxy URL is invalid, wrapping
+// ErrUnsupportedScheme for any other scheme.
 func DefaultTransportFactory(proxyURL string) (*http.Transport, error) {
-	u, err := url.Parse(proxyURL)
+	return defaultTransportRegistry.NewTransport(proxyURL)
+}
+
+// NewTransportFactory returns a factory creating transports like
+// DefaultTransportFactory, configured with opts, e.g. to bound the lifetime of
+// their connections.
+func NewTransportFactory(opts ...OptTransport) func(string) (*http.Transport, error) {
+	return defaultTransportRegistry.Factory(opts...)
+}
+
+// directSchemeTransport creates the transport of a direct proxy URL.
+func directSchemeTransport(u *url.URL, opts ...OptTransport) (*http.Transport, error) {
+	if bind := u.Query().Get("bind"); bind != "" {
+		ip, err := parseLocalAddr(bind)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, OptTransportWithLocalAddr(ip))
+	}
+	if u.Host != "" {
+		return PinnedDirectTransport(u.Hostname(), u.Port(), opts...)
+	}
+	return DirectTransport(opts...)
+}
+
+// localSchemeTransport creates the transport of a local proxy URL.
+func localSchemeTransport(u *url.URL, opts ...OptTransport) (*http.Transport, error) {
+	ip, err := parseLocalAddr(u.Hostname())
 	if err != nil {
 		return nil, err
 	}
+	return DirectTransport(append(opts, OptTransportWithLocalAddr(ip))...)
+}
 
-	switch u.Scheme {
-	case "http", "https":
-		return ProxyHTTPTransport(proxyURL)
-	case "direct":
-		return DirectTransport()
-	default:
-		return ProxySocks5Transport(proxyURL)
+// parseLocalAddr parses the local IP address of a local or bound direct proxy URL.
+func parseLocalAddr(addr string) (net.IP, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid local address %q", addr)
 	}
+	return ip, nil
 }
 
 // DirectTransportFactory creates multiple direct transports (no proxy).
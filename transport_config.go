@@ -0,0 +1,349 @@
+package hacktheconn
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+type (
+	// OptTransport configures the transports built by DirectTransport,
+	// PinnedDirectTransport, ProxyHTTPTransport, ProxySocks5Transport and the
+	// transport factories.
+	OptTransport = Option[TransportConfig]
+
+	TransportConfig struct {
+		// ConnLimits bounds the lifetime of connections.
+		ConnLimits ConnLimits
+		// DialTimeout bounds establishing a TCP connection, to the proxy if
+		// any. Defaults to 30s.
+		DialTimeout time.Duration
+		// LocalAddr, if set, is the local IP address connections are bound
+		// to, e.g. one of the public addresses of a multi-homed host.
+		LocalAddr net.IP
+		// ProxyHandshakeTimeout bounds the handshake with proxies once
+		// connected to them: the SOCKS5 handshake, or the TLS handshake with
+		// HTTPS proxies. Defaults to 10s.
+		ProxyHandshakeTimeout time.Duration
+		// TLSConfig configures TLS connections to servers, e.g. with root CAs,
+		// client certificates, a server name or a minimum version. Certificates
+		// are verified unless InsecureSkipVerify is set.
+		TLSConfig *tls.Config
+		// PinnedSPKIHashes, if not empty, are the base64-encoded SHA-256 hashes
+		// of the public keys servers may present, one of which must be in the
+		// verified certificate chain, or be the key of the server certificate
+		// when verification is disabled.
+		PinnedSPKIHashes []string
+		// InsecureSkipVerify disables certificate verification, of servers and
+		// of HTTPS proxies.
+		InsecureSkipVerify bool
+		// ProxyTLSConfig configures TLS connections to HTTPS proxies. The
+		// server name defaults to the host of the proxy.
+		ProxyTLSConfig *tls.Config
+		// GetProxyTLSConfig, if set, returns the TLS configuration of the
+		// HTTPS proxy at proxyURL instead of ProxyTLSConfig, e.g. to verify
+		// every proxy entry against its own roots. It is called once, when
+		// the transport is created.
+		GetProxyTLSConfig func(proxyURL *url.URL) (*tls.Config, error)
+		// ProxyCredentials, if set, returns the credentials sent to HTTP
+		// proxies in the Proxy-Authorization header, instead of the ones of
+		// the proxy URL. It is called once per request sent through a
+		// StrategyTransport, and for every request otherwise.
+		ProxyCredentials func(ctx context.Context, proxyURL *url.URL) (username, password string, err error)
+		// ProxyConnectHeader is sent to HTTP proxies with the CONNECT requests
+		// tunneling HTTPS requests, e.g. with vendor session or country
+		// selectors.
+		ProxyConnectHeader http.Header
+		// GetProxyConnectHeader, if set, returns the headers sent with CONNECT
+		// requests instead of ProxyConnectHeader.
+		GetProxyConnectHeader func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error)
+		// Logger, if set, logs the connections dialed, to the proxy if any.
+		Logger *slog.Logger
+	}
+)
+
+func newTransportConfig(opts []OptTransport) TransportConfig {
+	cfg := TransportConfig{
+		DialTimeout:           30 * time.Second,
+		ProxyHandshakeTimeout: 10 * time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return cfg
+}
+
+// dialer returns the dialer of TCP connections.
+func (cfg TransportConfig) dialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+	if cfg.LocalAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: cfg.LocalAddr}
+	}
+	return dialer
+}
+
+// apply configures t, dialing with the configured dialer unless t dials on
+// its own. Transports using the default dialer and TLS settings keep
+// attempting HTTP/2, as net/http does, unless connections are limited.
+func (cfg TransportConfig) apply(t *http.Transport) (*http.Transport, error) {
+	t.ForceAttemptHTTP2 = t.DialContext == nil && t.TLSClientConfig == nil && !cfg.ConnLimits.enabled()
+
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	t.TLSClientConfig = tlsConfig
+
+	if t.DialContext == nil {
+		t.DialContext = cfg.dialer().DialContext
+	}
+	if cfg.ConnLimits.enabled() {
+		t.DialContext = limitDial(t.DialContext, cfg.ConnLimits)
+	}
+	if cfg.Logger != nil {
+		t.DialContext = logDial(t.DialContext, cfg.Logger)
+	}
+
+	return t, nil
+}
+
+// tlsConfig returns the TLS configuration of connections to servers, or nil
+// for the defaults of net/http.
+func (cfg TransportConfig) tlsConfig() (*tls.Config, error) {
+	if cfg.TLSConfig == nil && len(cfg.PinnedSPKIHashes) == 0 && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.TLSConfig != nil {
+		tlsConfig = cfg.TLSConfig.Clone()
+	}
+	if cfg.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if len(cfg.PinnedSPKIHashes) > 0 {
+		pins := make(map[[sha256.Size]byte]bool, len(cfg.PinnedSPKIHashes))
+		for _, hash := range cfg.PinnedSPKIHashes {
+			pin, err := base64.StdEncoding.DecodeString(hash)
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("invalid pinned SPKI hash %q: must be a base64-encoded SHA-256 hash", hash)
+			}
+			pins[[sha256.Size]byte(pin)] = true
+		}
+
+		verify := tlsConfig.VerifyConnection
+		insecure := tlsConfig.InsecureSkipVerify
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(state); err != nil {
+					return err
+				}
+			}
+			return verifyPinnedSPKI(state, pins, insecure)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyPinnedSPKI checks that a certificate of the verified chains of the
+// server has one of the pinned public keys. Certificates the server sent
+// outside of a verified chain are ignored, since anyone can send them.
+// Without verification, only the leaf certificate is checked.
+func verifyPinnedSPKI(state tls.ConnectionState, pins map[[sha256.Size]byte]bool, insecure bool) error {
+	pinned := func(cert *x509.Certificate) bool {
+		return pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]
+	}
+
+	if insecure {
+		if len(state.PeerCertificates) > 0 && pinned(state.PeerCertificates[0]) {
+			return nil
+		}
+		return ErrPinMismatch
+	}
+
+	for _, chain := range state.VerifiedChains {
+		if slices.ContainsFunc(chain, pinned) {
+			return nil
+		}
+	}
+	return ErrPinMismatch
+}
+
+// proxyTLSConfig returns the TLS configuration of connections to the HTTPS
+// proxy at proxyURL.
+func (cfg TransportConfig) proxyTLSConfig(proxyURL *url.URL) (*tls.Config, error) {
+	base := cfg.ProxyTLSConfig
+	if cfg.GetProxyTLSConfig != nil {
+		var err error
+		if base, err = cfg.GetProxyTLSConfig(proxyURL); err != nil {
+			return nil, fmt.Errorf("getting proxy TLS config: %w", err)
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+	if base != nil {
+		tlsConfig = base.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = proxyURL.Hostname()
+	}
+	if cfg.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// OptTransportWithTLSConfig configures TLS connections to servers, e.g. with
+// root CAs, client certificates for mTLS, a server name to send as SNI or a
+// minimum version. The configuration is cloned.
+func OptTransportWithTLSConfig(tlsConfig *tls.Config) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.TLSConfig = tlsConfig
+	}
+}
+
+// OptTransportWithPinnedSPKI only accepts servers whose verified certificate
+// chain has a certificate whose public key has one of the given
+// base64-encoded SHA-256 hashes, as printed by:
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func OptTransportWithPinnedSPKI(hashes ...string) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.PinnedSPKIHashes = append(cfg.PinnedSPKIHashes, hashes...)
+	}
+}
+
+// OptTransportWithInsecureSkipVerify disables certificate verification, of
+// servers and of HTTPS proxies, which exposes connections to
+// man-in-the-middle attacks. Only use it for testing.
+func OptTransportWithInsecureSkipVerify() OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.InsecureSkipVerify = true
+	}
+}
+
+// OptTransportWithDialTimeout bounds establishing a TCP connection, to the
+// proxy if any.
+func OptTransportWithDialTimeout(timeout time.Duration) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.DialTimeout = timeout
+	}
+}
+
+// OptTransportWithLocalAddr binds connections, to the proxy if any, to the
+// local IP address ip.
+func OptTransportWithLocalAddr(ip net.IP) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.LocalAddr = ip
+	}
+}
+
+// OptTransportWithProxyHandshakeTimeout bounds the handshake with SOCKS5
+// proxies, including authentication and the CONNECT request.
+func OptTransportWithProxyHandshakeTimeout(timeout time.Duration) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.ProxyHandshakeTimeout = timeout
+	}
+}
+
+// OptTransportWithMaxConnAge recycles connections once they are older than age.
+func OptTransportWithMaxConnAge(age time.Duration) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.ConnLimits.MaxAge = age
+	}
+}
+
+// OptTransportWithMaxConnRequests recycles connections once they served n requests.
+func OptTransportWithMaxConnRequests(n int) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.ConnLimits.MaxRequests = n
+	}
+}
+
+// OptTransportWithConnJitter lowers the limits of every connection by a random
+// fraction up to jitter, e.g. 0.1 for 10%.
+func OptTransportWithConnJitter(jitter float64) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.ConnLimits.Jitter = jitter
+	}
+}
+
+// OptTransportWithConnRecycleHandler configures a callback for connection recycle events.
+func OptTransportWithConnRecycleHandler(fn func(ConnRecycleEvent)) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.ConnLimits.OnRecycle = fn
+	}
+}
+
+// OptTransportWithProxyTLSConfig configures TLS connections to HTTPS proxies,
+// e.g. with the root CAs of the proxy or client certificates. The
+// configuration is cloned.
+func OptTransportWithProxyTLSConfig(tlsConfig *tls.Config) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.ProxyTLSConfig = tlsConfig
+	}
+}
+
+// OptTransportWithProxyTLSConfigFunc configures a callback returning the TLS
+// configuration of connections to HTTPS proxies, given the proxy URL of the
+// transport, e.g. to pick root CAs or client certificates per proxy entry.
+// The configuration is cloned.
+func OptTransportWithProxyTLSConfigFunc(fn func(proxyURL *url.URL) (*tls.Config, error)) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.GetProxyTLSConfig = fn
+	}
+}
+
+// OptTransportWithProxyCredentials configures a callback returning the
+// credentials sent to HTTP proxies, e.g. to rotate them. It is called for
+// every request, with the proxy URL of the transport, so it should be cheap.
+// Requests sent through a StrategyTransport call it once per proxy, even when
+// the proxy answers 407 or net/http asks for the proxy again.
+func OptTransportWithProxyCredentials(
+	fn func(ctx context.Context, proxyURL *url.URL) (username, password string, err error),
+) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.ProxyCredentials = fn
+	}
+}
+
+// OptTransportWithProxyConnectHeader configures headers sent to HTTP proxies
+// with CONNECT requests.
+func OptTransportWithProxyConnectHeader(header http.Header) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.ProxyConnectHeader = header
+	}
+}
+
+// OptTransportWithProxyConnectHeaderFunc configures a callback returning the
+// headers sent to HTTP proxies with CONNECT requests, given the proxy URL of
+// the transport and the target address, e.g. to pick headers per proxy entry.
+func OptTransportWithProxyConnectHeaderFunc(
+	fn func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error),
+) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.GetProxyConnectHeader = fn
+	}
+}
+
+// OptTransportWithLogger logs the connections dialed by the transport, to the
+// proxy if any, and the dials that fail. Strategies configured with a logger
+// already log the dials of the transports they create.
+func OptTransportWithLogger(logger *slog.Logger) OptTransport {
+	return func(cfg *TransportConfig) {
+		cfg.Logger = logger
+	}
+}
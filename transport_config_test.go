@@ -0,0 +1,147 @@
+package hacktheconn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTLSUpstream(t *testing.T) (*httptest.Server, *x509.CertPool, string) {
+	t.Helper()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	pin := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+
+	return server, roots, base64.StdEncoding.EncodeToString(pin[:])
+}
+
+func TestTransportVerifiesCertificates(t *testing.T) {
+	server, roots, _ := newTLSUpstream(t)
+
+	transport, err := DirectTransport()
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.ErrorAs(t, err, new(*tls.CertificateVerificationError))
+
+	transport, err = DirectTransport(OptTransportWithTLSConfig(&tls.Config{RootCAs: roots}))
+	require.NoError(t, err)
+	get(t, &http.Client{Transport: transport}, server.URL)
+
+	transport, err = DirectTransport(OptTransportWithInsecureSkipVerify())
+	require.NoError(t, err)
+	get(t, &http.Client{Transport: transport}, server.URL)
+}
+
+func TestTransportVerifiesCertificatesThroughSocks5(t *testing.T) {
+	server, roots, _ := newTLSUpstream(t)
+	proxy := newSocks5Server(t, server.Listener.Addr().String(), nil)
+
+	transport, err := ProxySocks5Transport("socks5h://" + proxy.addr())
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.ErrorAs(t, err, new(*tls.CertificateVerificationError))
+
+	transport, err = NewTransportFactory(
+		OptTransportWithTLSConfig(&tls.Config{RootCAs: roots}),
+	)("socks5h://" + proxy.addr())
+	require.NoError(t, err)
+	get(t, &http.Client{Transport: transport}, server.URL)
+}
+
+func TestTransportPinnedSPKI(t *testing.T) {
+	server, roots, pin := newTLSUpstream(t)
+	tlsConfig := &tls.Config{RootCAs: roots}
+
+	transport, err := DirectTransport(OptTransportWithTLSConfig(tlsConfig), OptTransportWithPinnedSPKI(pin))
+	require.NoError(t, err)
+	get(t, &http.Client{Transport: transport}, server.URL)
+
+	other := sha256.Sum256([]byte("other key"))
+	transport, err = DirectTransport(
+		OptTransportWithTLSConfig(tlsConfig),
+		OptTransportWithPinnedSPKI(base64.StdEncoding.EncodeToString(other[:])),
+	)
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.ErrorIs(t, err, ErrPinMismatch)
+	assert.Nil(t, tlsConfig.VerifyConnection, "the given configuration is not modified")
+
+	_, err = DirectTransport(OptTransportWithPinnedSPKI("not a hash"))
+	assert.Error(t, err)
+}
+
+// newUnrelatedCertificate creates a self-signed CA certificate, returning its
+// DER encoding and the pin of its public key.
+func newUnrelatedCertificate(t *testing.T) ([]byte, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return der, base64.StdEncoding.EncodeToString(pin[:])
+}
+
+func TestTransportPinnedSPKIIgnoresUnverifiedCertificates(t *testing.T) {
+	server, roots, _ := newTLSUpstream(t)
+	unrelated, pin := newUnrelatedCertificate(t)
+
+	// The server sends the pinned certificate along with its valid chain,
+	// which anyone holding a trusted certificate for the host can do.
+	server.TLS.Certificates[0].Certificate = append(server.TLS.Certificates[0].Certificate, unrelated)
+
+	transport, err := DirectTransport(
+		OptTransportWithTLSConfig(&tls.Config{RootCAs: roots}),
+		OptTransportWithPinnedSPKI(pin),
+	)
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.ErrorIs(t, err, ErrPinMismatch)
+
+	transport, err = DirectTransport(OptTransportWithInsecureSkipVerify(), OptTransportWithPinnedSPKI(pin))
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.ErrorIs(t, err, ErrPinMismatch)
+}
+
+func TestTransportPinnedSPKIInsecureChecksLeaf(t *testing.T) {
+	server, _, pin := newTLSUpstream(t)
+
+	transport, err := DirectTransport(OptTransportWithInsecureSkipVerify(), OptTransportWithPinnedSPKI(pin))
+	require.NoError(t, err)
+	get(t, &http.Client{Transport: transport}, server.URL)
+}
@@ -1,15 +1,77 @@
 package hacktheconn
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
 )
 
 // DirectTransport creates a transport that connects directly (no proxy).
 // Each transport instance will create its own connection pool, allowing
 // multiple connections to the same host for load balancing scenarios.
-func DirectTransport() (*http.Transport, error) {
-	return &http.Transport{
+func DirectTransport(opts ...OptTransport) (*http.Transport, error) {
+	return newTransportConfig(opts).apply(&http.Transport{
 		MaxConnsPerHost: 1,
 		MaxIdleConns:    1,
-	}, nil
+	})
+}
+
+// PinnedDirectTransport creates a direct transport that connects to host
+// whatever the host of the request, e.g. to reach one backend IP behind a
+// hostname. When port is empty, the port of the request is used. TLS still
+// verifies the certificate against the host of the request.
+func PinnedDirectTransport(host, port string, opts ...OptTransport) (*http.Transport, error) {
+	cfg := newTransportConfig(opts)
+	dialer := cfg.dialer()
+
+	return cfg.apply(&http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			pinnedPort := port
+			if pinnedPort == "" {
+				_, requestPort, err := net.SplitHostPort(address)
+				if err != nil {
+					return nil, err
+				}
+				pinnedPort = requestPort
+			}
+			return dialer.DialContext(ctx, network, net.JoinHostPort(host, pinnedPort))
+		},
+		MaxConnsPerHost: 1,
+		MaxIdleConns:    1,
+	})
+}
+
+// UnixSocketTransport creates a transport that connects to the unix domain
+// socket at path whatever the host of the request, e.g. to reach a sidecar
+// proxy such as Envoy listening on "/var/run/envoy.sock".
+func UnixSocketTransport(path string, opts ...OptTransport) (*http.Transport, error) {
+	if path == "" {
+		return nil, errors.New("unix socket path is empty")
+	}
+
+	cfg := newTransportConfig(opts)
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+
+	return cfg.apply(&http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", path)
+		},
+		MaxConnsPerHost: 1,
+		MaxIdleConns:    1,
+	})
+}
+
+// DialerTransport creates a transport that opens its connections with dial,
+// e.g. the Dial method of an SSH client to tunnel requests. Timeouts and local
+// addresses of opts are up to dial.
+func DialerTransport(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+	opts ...OptTransport,
+) (*http.Transport, error) {
+	return newTransportConfig(opts).apply(&http.Transport{
+		DialContext:     dial,
+		MaxConnsPerHost: 1,
+		MaxIdleConns:    1,
+	})
 }
@@ -0,0 +1,53 @@
+package hacktheconn
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// LocalAddressProxies lists the IP addresses of the local network interfaces
+// as "local://" proxy URLs, one per address, so that strategies rotate source
+// IPs the way they rotate proxies. Only the addresses of the named interfaces
+// are listed, if any are given; otherwise the ones of every interface that is
+// up, except loopback ones. Link-local addresses are skipped.
+func LocalAddressProxies(interfaces ...string) ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("listing network interfaces: %w", err)
+	}
+
+	var proxies []string
+	for _, iface := range ifaces {
+		if len(interfaces) > 0 {
+			if !slices.Contains(interfaces, iface.Name) {
+				continue
+			}
+		} else if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("listing addresses of %s: %w", iface.Name, err)
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			proxies = append(proxies, localProxyURL(ipNet.IP))
+		}
+	}
+
+	return proxies, nil
+}
+
+// localProxyURL returns the proxy URL of a direct transport bound to ip.
+func localProxyURL(ip net.IP) string {
+	if ip.To4() == nil {
+		return "local://[" + ip.String() + "]"
+	}
+	return "local://" + ip.String()
+}
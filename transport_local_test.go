@@ -0,0 +1,67 @@
+package hacktheconn
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalTransportBindsSourceAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		_, _ = io.WriteString(w, host)
+	}))
+	defer server.Close()
+
+	sourceOf := func(proxyURL string) string {
+		transport, err := DefaultTransportFactory(proxyURL)
+		require.NoError(t, err)
+
+		res, err := (&http.Client{Transport: transport}).Get(server.URL)
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return string(body)
+	}
+
+	// The whole 127.0.0.0/8 block is local on Linux.
+	assert.Equal(t, "127.0.0.2", sourceOf("local://127.0.0.2"))
+	assert.Equal(t, "127.0.0.3", sourceOf("direct://?bind=127.0.0.3"))
+	assert.Equal(t, "127.0.0.4", sourceOf("direct://"+server.Listener.Addr().String()+"?bind=127.0.0.4"))
+
+	_, err := DefaultTransportFactory("local://not-an-ip")
+	assert.Error(t, err)
+}
+
+func TestLocalAddressProxies(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	proxies, err := LocalAddressProxies(loopback)
+	require.NoError(t, err)
+	assert.Contains(t, proxies, "local://127.0.0.1")
+
+	proxies, err = LocalAddressProxies()
+	require.NoError(t, err)
+	assert.NotContains(t, proxies, "local://127.0.0.1", "loopback interfaces are skipped unless named")
+	for _, proxy := range proxies {
+		_, err := DefaultTransportFactory(proxy)
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,99 @@
+package hacktheconn
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// TransportSchemeFactory creates the transport of a proxy URL of the scheme it
+// is registered for, configured with opts.
+type TransportSchemeFactory func(proxyURL *url.URL, opts ...OptTransport) (*http.Transport, error)
+
+// TransportRegistry maps proxy URL schemes to the factories creating their
+// transports. Registries are independent of each other, so that every pool or
+// strategy can be given its own, e.g. with a scheme for an SSH tunnel.
+type TransportRegistry struct {
+	mutex   sync.RWMutex
+	schemes map[string]TransportSchemeFactory
+}
+
+// defaultTransportRegistry backs DefaultTransportFactory. It is never changed.
+var defaultTransportRegistry = NewTransportRegistry()
+
+// NewTransportRegistry creates a registry with the built-in schemes: "http",
+// "https", "socks5", "socks5h", "direct", "local" and "unix".
+func NewTransportRegistry() *TransportRegistry {
+	proxyHTTP := func(u *url.URL, opts ...OptTransport) (*http.Transport, error) {
+		return ProxyHTTPTransport(u.String(), opts...)
+	}
+	proxySocks5 := func(u *url.URL, opts ...OptTransport) (*http.Transport, error) {
+		return ProxySocks5Transport(u.String(), opts...)
+	}
+
+	return &TransportRegistry{schemes: map[string]TransportSchemeFactory{
+		"http":    proxyHTTP,
+		"https":   proxyHTTP,
+		"socks5":  proxySocks5,
+		"socks5h": proxySocks5,
+		"direct":  directSchemeTransport,
+		"local":   localSchemeTransport,
+		"unix": func(u *url.URL, opts ...OptTransport) (*http.Transport, error) {
+			return UnixSocketTransport(u.Path, opts...)
+		},
+	}}
+}
+
+// Register registers factory for scheme, replacing the factory of the scheme,
+// if any. Schemes are case-insensitive.
+func (r *TransportRegistry) Register(scheme string, factory TransportSchemeFactory) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.schemes[strings.ToLower(scheme)] = factory
+}
+
+// Schemes returns the registered schemes, sorted.
+func (r *TransportRegistry) Schemes() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	schemes := make([]string, 0, len(r.schemes))
+	for scheme := range r.schemes {
+		schemes = append(schemes, scheme)
+	}
+	slices.Sort(schemes)
+	return schemes
+}
+
+// NewTransport creates the transport of proxyURL with the factory registered
+// for its scheme, configured with opts. It returns an error wrapping
+// ErrUnsupportedScheme if the scheme is not registered.
+func (r *TransportRegistry) NewTransport(proxyURL string, opts ...OptTransport) (*http.Transport, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.RLock()
+	factory, ok := r.schemes[u.Scheme]
+	r.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %q in %s", ErrUnsupportedScheme, u.Scheme, u.Redacted())
+	}
+
+	// Factories may append options, without touching the ones of the caller.
+	return factory(u, slices.Clip(opts)...)
+}
+
+// Factory returns a transport factory creating transports with the registry,
+// configured with opts, to be given to pools and strategies.
+func (r *TransportRegistry) Factory(opts ...OptTransport) func(string) (*http.Transport, error) {
+	return func(proxyURL string) (*http.Transport, error) {
+		return r.NewTransport(proxyURL, opts...)
+	}
+}
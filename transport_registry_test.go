@@ -0,0 +1,71 @@
+package hacktheconn
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportRegistryUnsupportedScheme(t *testing.T) {
+	for _, proxyURL := range []string{"htp://proxy:8080", "proxy:1080", "ssh://bastion"} {
+		_, err := DefaultTransportFactory(proxyURL)
+		assert.ErrorIs(t, err, ErrUnsupportedScheme, proxyURL)
+	}
+
+	_, err := DefaultTransportFactory("SOCKS5://proxy:1080")
+	assert.NoError(t, err, "schemes are case-insensitive")
+}
+
+func TestTransportRegistryRegister(t *testing.T) {
+	server := newUpstream(t)
+
+	var dials atomic.Int64
+	registry := NewTransportRegistry()
+	registry.Register("ssh", func(u *url.URL, opts ...OptTransport) (*http.Transport, error) {
+		assert.Equal(t, "bastion", u.Host)
+		return DialerTransport(func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dials.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		}, opts...)
+	})
+	assert.Contains(t, registry.Schemes(), "ssh")
+	assert.NotContains(t, NewTransportRegistry().Schemes(), "ssh", "registries are independent")
+
+	pool := NewPool(NewRoundRobinStrategy(nil), OptPoolWithTransportFactory(registry.Factory()))
+	require.NoError(t, pool.Add("ssh://bastion"))
+
+	get(t, &http.Client{Transport: Transport(pool)}, "http://backend.test/")
+	assert.Equal(t, int64(1), dials.Load())
+}
+
+func TestUnixSocketTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Host)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	transport, err := DefaultTransportFactory("unix://" + path)
+	require.NoError(t, err)
+
+	res, err := (&http.Client{Transport: transport}).Get("http://backend.test/")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, "backend.test", string(body))
+}